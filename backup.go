@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/task"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+)
+
+const (
+	DefaultBackupInterval = 24 * 60 * 60
+	DefaultBackupKeep     = 7
+
+	backupPrefix     = "spacemesh-storage-proxy-"
+	backupSuffix     = ".db"
+	backupTimeFormat = "20060102T150405"
+)
+
+var (
+	dbBackups        = metrics.NewCounter("spacemesh_proxy_db_backups_total", "Database backups", "result")
+	dbLastBackupTime = metrics.NewGauge("spacemesh_proxy_db_last_backup_timestamp_seconds", "Time of the last successful database backup")
+)
+
+// backupLoop 配置了 backup_dir 时定期备份数据库
+func (p *StorageProxy) backupLoop() {
+	lastBackup := time.Time{}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		cfg := p.snapshot()
+		if cfg.BackupDir == "" || time.Since(lastBackup) < durationOr(cfg.BackupInterval, DefaultBackupInterval) {
+			continue
+		}
+		lastBackup = time.Now()
+		if _, err := p.backup(cfg); err != nil {
+			log.Errorf(log.Fields{}, "fail to backup database to %v: %v", cfg.BackupDir, err)
+		}
+	}
+}
+
+// backup 备份到 backup_dir 并删除多余的旧备份
+func (p *StorageProxy) backup(cfg StorageProxyConfig) (string, error) {
+	if err := os.MkdirAll(cfg.BackupDir, 0700); err != nil {
+		dbBackups.Inc("failed")
+		return "", err
+	}
+	path := filepath.Join(cfg.BackupDir, backupPrefix+time.Now().Format(backupTimeFormat)+backupSuffix)
+	n, err := db.BackupFile(path)
+	if err != nil {
+		dbBackups.Inc("failed")
+		return "", err
+	}
+	log.Infof(log.Fields{}, "database backup %v, %v bytes", path, n)
+	dbBackups.Inc("ok")
+	dbLastBackupTime.Set(float64(time.Now().Unix()))
+
+	keep := cfg.BackupKeep
+	if keep <= 0 {
+		keep = DefaultBackupKeep
+	}
+	files, err := ioutil.ReadDir(cfg.BackupDir)
+	if err != nil {
+		return path, err
+	}
+	backups := []string{}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), backupPrefix) && strings.HasSuffix(f.Name(), backupSuffix) {
+			backups = append(backups, f.Name())
+		}
+	}
+	// 文件名按时间排序
+	sort.Strings(backups)
+	for len(backups) > keep {
+		old := filepath.Join(cfg.BackupDir, backups[0])
+		if err := os.Remove(old); err != nil {
+			log.Errorf(log.Fields{}, "fail to remove old backup %v: %v", old, err)
+		}
+		backups = backups[1:]
+	}
+	return path, nil
+}
+
+// BackupHandler 下载数据库的一致快照, 不写入磁盘
+func (p *StorageProxy) BackupHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", backupPrefix+time.Now().Format(backupTimeFormat)+backupSuffix))
+	if _, err := db.Backup(w); err != nil {
+		log.Errorf(log.Fields{}, "fail to backup database to %v: %v", req.RemoteAddr, err)
+	}
+}
+
+// SaveBackupRequest 立即备份到 backup_dir 并删除多余的旧备份
+func (p *StorageProxy) SaveBackupRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	cfg := p.snapshot()
+	if cfg.BackupDir == "" {
+		return nil, "backup_dir is not configured", -2
+	}
+	path, err := p.backup(cfg)
+	if err != nil {
+		return nil, err.Error(), -1
+	}
+	return types.SaveBackupOutput{
+		Path: path,
+	}, "", 0
+}
+
+// ExportHandler 导出任务, ?format=ndjson 时每行一条记录
+func (p *StorageProxy) ExportHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := req.URL.Query().Get("format")
+	switch format {
+	case "", task.ExportJSON:
+		format = task.ExportJSON
+		w.Header().Set("Content-Type", "application/json")
+	case task.ExportNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %v", format), http.StatusBadRequest)
+		return
+	}
+	if err := task.ExportTo(w, format); err != nil {
+		log.Errorf(log.Fields{}, "fail to export to %v: %v", req.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/task"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+// commandDatabase 按配置打开数据库, 服务运行时数据库被锁定, 需先停止服务
+func commandDatabase(cctx *cli.Context) error {
+	cfgFile := cctx.String("config")
+	cfg, _, err := readConfig(cfgFile, cliOverrides(cctx))
+	if err != nil {
+		return xerrors.Errorf("cannot read config %v: %v", cfgFile, err)
+	}
+	if err := openDatabase(cfg); err != nil {
+		return xerrors.Errorf("%v, stop spacemesh-storage-proxy or use --db-path with a backup", err)
+	}
+	return nil
+}
+
+func closeDatabase() {
+	task.CloseStore()
+	db.Close()
+}
+
+var exportCommand = &cli.Command{
+	Name:  "export",
+	Usage: "Export tasks, history and jobs as json or ndjson",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "output",
+			Value: "-",
+			Usage: "output file, - for stdout",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "json or ndjson, by extension of output by default",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if err := commandDatabase(cctx); err != nil {
+			return err
+		}
+		defer closeDatabase()
+
+		output := cctx.String("output")
+		format := cctx.String("format")
+		if format == "" {
+			format = task.ExportFormat(output)
+		}
+
+		var w io.Writer = os.Stdout
+		if output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return task.ExportTo(w, format)
+	},
+}
+
+var importCommand = &cli.Command{
+	Name:  "import",
+	Usage: "Import the output of export, to restore or move to a new machine",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "input",
+			Required: true,
+			Usage:    "input file, - for stdin",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "json or ndjson, by extension of input by default",
+		},
+		&cli.BoolFlag{
+			Name:  "replace",
+			Usage: "overwrite existing records instead of skipping them",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if err := commandDatabase(cctx); err != nil {
+			return err
+		}
+		defer closeDatabase()
+
+		input := cctx.String("input")
+		format := cctx.String("format")
+		if format == "" {
+			format = task.ExportFormat(input)
+		}
+
+		var r io.Reader = os.Stdin
+		if input != "-" {
+			f, err := os.Open(input)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		result, err := task.ImportFrom(r, format, cctx.Bool("replace"))
+		b, _ := json.Marshal(result)
+		os.Stdout.Write(append(b, '\n'))
+		return err
+	},
+}
+
+var placementCommand = &cli.Command{
+	Name:  "placement",
+	Usage: "Query which storage host holds the PoST of a node through the running proxy",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "node-id",
+			Usage: "node id or its prefix, all nodes by default",
+		},
+		&cli.StringFlag{
+			Name:  "storage-host",
+			Usage: "only placements on this storage host",
+		},
+		&cli.StringFlag{
+			Name:  "api",
+			Usage: "api address of the proxy, http://127.0.0.1:<port> by default",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		addr := cctx.String("api")
+		if addr == "" {
+			cfgFile := cctx.String("config")
+			cfg, _, err := readConfig(cfgFile, cliOverrides(cctx))
+			if err != nil {
+				return xerrors.Errorf("cannot read config %v: %v", cfgFile, err)
+			}
+			addr = fmt.Sprintf("http://127.0.0.1:%v", cfg.Port)
+		}
+
+		query := url.Values{}
+		query.Set("node_id", cctx.String("node-id"))
+		query.Set("host", cctx.String("storage-host"))
+		client := http.Client{Timeout: task.DefaultRequestTimeout * time.Second}
+		resp, err := client.Get(addr + types.ListPlacementAPI + "?" + query.Encode())
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		apiResp := struct {
+			Code int                       `json:"code"`
+			Msg  string                    `json:"msg"`
+			Body types.ListPlacementOutput `json:"body"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+			return err
+		}
+		if apiResp.Code != 0 {
+			return xerrors.Errorf("query placement: %v", apiResp.Msg)
+		}
+		b, err := json.MarshalIndent(apiResp.Body.Placements, "", "  ")
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(append(b, '\n'))
+		return nil
+	},
+}
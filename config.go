@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/task"
+)
+
+type StorageProxyConfig struct {
+	DBPath         string   `json:"db_path" yaml:"db_path" toml:"db_path"`
+	LocalPlot      bool     `json:"localplot" yaml:"localplot" toml:"localplot"`
+	LocalHost      string   `json:"host" yaml:"host" toml:"host"`
+	Port           int      `json:"port" yaml:"port" toml:"port"`
+	FileServerPort int      `json:"file_server_port" yaml:"file_server_port" toml:"file_server_port"`
+	StorageHosts   []string `json:"storage_hosts" yaml:"storage_hosts" toml:"storage_hosts"`
+	PlotPaths      []string `json:"plot_paths" yaml:"plot_paths" toml:"plot_paths"`
+	// 目录索引失败后的退避时间, 单位秒
+	IndexBackoffBase int `json:"index_backoff_base" yaml:"index_backoff_base" toml:"index_backoff_base"`
+	IndexBackoffMax  int `json:"index_backoff_max" yaml:"index_backoff_max" toml:"index_backoff_max"`
+	// 同时索引的 PlotPath 数量
+	IndexConcurrency int `json:"index_concurrency" yaml:"index_concurrency" toml:"index_concurrency"`
+	// 单个 PlotPath 索引超时, 单位秒
+	IndexTimeout int `json:"index_timeout" yaml:"index_timeout" toml:"index_timeout"`
+	// 磁盘剩余空间百分比低于该值时暂停接受新的 plot
+	DiskPausePercent float64 `json:"disk_pause_percent" yaml:"disk_pause_percent" toml:"disk_pause_percent"`
+	// 磁盘剩余空间百分比低于该值时优先传输
+	DiskDrainPercent float64 `json:"disk_drain_percent" yaml:"disk_drain_percent" toml:"disk_drain_percent"`
+	// 任务调度排序条件, 可选 priority, disk_free, age, size
+	ScheduleOrder []string `json:"schedule_order" yaml:"schedule_order" toml:"schedule_order"`
+	// 端口变更后等待旧端口上的传输完成的时间, 单位秒
+	DrainTimeout int `json:"drain_timeout" yaml:"drain_timeout" toml:"drain_timeout"`
+	// 收到 SIGTERM/SIGINT 后等待正在执行的任务及传输完成的时间, 单位秒
+	ShutdownTimeout int `json:"shutdown_timeout" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// 任务存储, 可选 bolt, sqlite, 只在启动时生效
+	TaskStore     string `json:"task_store" yaml:"task_store" toml:"task_store"`
+	TaskStorePath string `json:"task_store_path" yaml:"task_store_path" toml:"task_store_path"`
+	// 已完成或失败的任务在本地文件移除后多久归档, 归档后保留多久, 单位秒
+	HistoryArchiveAfter int `json:"history_archive_after" yaml:"history_archive_after" toml:"history_archive_after"`
+	HistoryRetention    int `json:"history_retention" yaml:"history_retention" toml:"history_retention"`
+	// 检查是否需要压缩数据库的间隔, 单位秒
+	CompactInterval int `json:"compact_interval" yaml:"compact_interval" toml:"compact_interval"`
+	// 定期备份数据库的目录, 为空时不备份, 间隔单位秒
+	BackupDir      string `json:"backup_dir" yaml:"backup_dir" toml:"backup_dir"`
+	BackupInterval int    `json:"backup_interval" yaml:"backup_interval" toml:"backup_interval"`
+	BackupKeep     int    `json:"backup_keep" yaml:"backup_keep" toml:"backup_keep"`
+	// 清理目录前计算每个文件的 sha256 记录到 placement
+	PlacementChecksum bool `json:"placement_checksum" yaml:"placement_checksum" toml:"placement_checksum"`
+	// 处理任务的租约时长, 单位秒, 进程崩溃后超过该时间的任务重新处理
+	LeaseTTL int `json:"lease_ttl" yaml:"lease_ttl" toml:"lease_ttl"`
+	// 访问存储节点及通知地址的超时, 单位秒
+	RequestTimeout int `json:"request_timeout" yaml:"request_timeout" toml:"request_timeout"`
+	// wait 的任务超过该时间没有发送数据视为停滞并重新派发, 单位秒
+	StallTimeout int `json:"stall_timeout" yaml:"stall_timeout" toml:"stall_timeout"`
+	// 通知失败或停滞后的重试次数 (0 不限制) 及退避时间, 单位秒
+	RetryMax         int  `json:"retry_max" yaml:"retry_max" toml:"retry_max"`
+	RetryBackoffBase int  `json:"retry_backoff_base" yaml:"retry_backoff_base" toml:"retry_backoff_base"`
+	RetryBackoffMax  int  `json:"retry_backoff_max" yaml:"retry_backoff_max" toml:"retry_backoff_max"`
+	RetryOtherHost   bool `json:"retry_other_host" yaml:"retry_other_host" toml:"retry_other_host"`
+	// 事件记录保留的时间, 单位秒, 为 0 时不清理
+	EventRetention int `json:"event_retention" yaml:"event_retention" toml:"event_retention"`
+	// 事件通知地址
+	Webhooks []WebhookConfig `json:"webhooks" yaml:"webhooks" toml:"webhooks"`
+	// 同时处理的任务数及内存中等待的任务数, 修改后重启生效
+	QueueWorkers int `json:"queue_workers" yaml:"queue_workers" toml:"queue_workers"`
+	QueueBacklog int `json:"queue_backlog" yaml:"queue_backlog" toml:"queue_backlog"`
+}
+
+const cfgWatchInterval = 5 * time.Second
+
+// Validate 校验配置, 返回所有不合法的字段
+func (cfg StorageProxyConfig) Validate() error {
+	errs := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(cfg.LocalPlot || cfg.LocalHost != "", "host is required")
+	check(0 < cfg.Port && cfg.Port < 65536, "port %v out of range [1, 65535]", cfg.Port)
+	check(0 < cfg.FileServerPort && cfg.FileServerPort < 65536, "file_server_port %v out of range [1, 65535]", cfg.FileServerPort)
+	check(cfg.Port != cfg.FileServerPort, "port and file_server_port must differ")
+	check(len(cfg.StorageHosts) > 0, "storage_hosts must not be empty")
+	for i, host := range cfg.StorageHosts {
+		check(host != "", "storage_hosts[%v] is empty", i)
+	}
+	for i, path := range cfg.PlotPaths {
+		info, err := os.Stat(path)
+		if err != nil {
+			check(false, "plot_paths[%v] %v", i, err)
+			continue
+		}
+		check(info.IsDir(), "plot_paths[%v] %v is not a directory", i, path)
+	}
+	check(cfg.IndexBackoffBase >= 0, "index_backoff_base must not be negative")
+	check(cfg.IndexBackoffMax >= 0, "index_backoff_max must not be negative")
+	check(cfg.IndexConcurrency >= 0, "index_concurrency must not be negative")
+	check(cfg.IndexTimeout >= 0, "index_timeout must not be negative")
+	check(cfg.HistoryArchiveAfter >= 0, "history_archive_after must not be negative")
+	check(cfg.HistoryRetention >= 0, "history_retention must not be negative")
+	check(cfg.CompactInterval >= 0, "compact_interval must not be negative")
+	check(cfg.LeaseTTL >= 0, "lease_ttl must not be negative")
+	check(cfg.RequestTimeout >= 0, "request_timeout must not be negative")
+	check(cfg.StallTimeout >= 0, "stall_timeout must not be negative")
+	check(cfg.RetryMax >= 0, "retry_max must not be negative")
+	check(cfg.RetryBackoffBase >= 0, "retry_backoff_base must not be negative")
+	check(cfg.RetryBackoffMax >= 0, "retry_backoff_max must not be negative")
+	check(cfg.EventRetention >= 0, "event_retention must not be negative")
+	// 每个地址一个投递队列, 按地址查找配置
+	hookURLs := map[string]int{}
+	for i, hook := range cfg.Webhooks {
+		u, err := url.Parse(hook.URL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "webhooks[%v] url %v must be http(s)", i, hook.URL)
+		if j, ok := hookURLs[hook.URL]; ok {
+			check(false, "webhooks[%v] url %v duplicates webhooks[%v], merge their events", i, hook.URL, j)
+		}
+		hookURLs[hook.URL] = i
+		check(hook.Retries == nil || *hook.Retries >= 0, "webhooks[%v] retries must not be negative", i)
+		for _, e := range hook.Events {
+			check(event.Valid(e), "webhooks[%v] unknown event %v, available %v", i, e, event.Types())
+		}
+	}
+	check(cfg.QueueWorkers >= 0, "queue_workers must not be negative")
+	check(cfg.QueueBacklog >= 0, "queue_backlog must not be negative")
+	check(cfg.BackupInterval >= 0, "backup_interval must not be negative")
+	check(cfg.BackupKeep >= 0, "backup_keep must not be negative")
+	check(cfg.TaskStore == "" || task.HasStore(cfg.TaskStore), "task_store %v not supported, available %v", cfg.TaskStore, task.StoreNames())
+	check(cfg.DrainTimeout >= 0, "drain_timeout must not be negative")
+	check(cfg.ShutdownTimeout >= 0, "shutdown_timeout must not be negative")
+	check(0 <= cfg.DiskPausePercent && cfg.DiskPausePercent <= 100, "disk_pause_percent %v out of range [0, 100]", cfg.DiskPausePercent)
+	check(0 <= cfg.DiskDrainPercent && cfg.DiskDrainPercent <= 100, "disk_drain_percent %v out of range [0, 100]", cfg.DiskDrainPercent)
+	for _, o := range cfg.ScheduleOrder {
+		switch o {
+		case task.OrderPriority, task.OrderDiskFree, task.OrderAge, task.OrderSize:
+		default:
+			check(false, "unknown schedule_order %v", o)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// loadConfig 读取并校验配置文件, 返回配置及文件的校验和
+// 优先级从低到高: 配置文件, 环境变量, 命令行参数
+// 配置文件不存在时只使用环境变量及命令行参数
+func loadConfig(cfgFile string, flags map[string]string) (StorageProxyConfig, string, error) {
+	cfg, sum, err := readConfig(cfgFile, flags)
+	if err != nil {
+		return cfg, sum, err
+	}
+	return cfg, sum, cfg.Validate()
+}
+
+// readConfig 按优先级合并配置, 不做校验
+func readConfig(cfgFile string, flags map[string]string) (StorageProxyConfig, string, error) {
+	cfg := StorageProxyConfig{}
+	buf, err := ioutil.ReadFile(cfgFile)
+	if err != nil && !os.IsNotExist(err) {
+		return cfg, "", err
+	}
+	m5 := md5.Sum(buf)
+	sum := hex.EncodeToString(m5[:])
+
+	if len(buf) > 0 {
+		if err := unmarshalConfig(cfgFile, buf, &cfg); err != nil {
+			return cfg, sum, err
+		}
+	}
+	if err := overrideConfig(&cfg, envOverrides()); err != nil {
+		return cfg, sum, err
+	}
+	if err := overrideConfig(&cfg, flags); err != nil {
+		return cfg, sum, err
+	}
+	if cfg.LocalPlot {
+		cfg.LocalHost = "127.0.0.1"
+	}
+	return cfg, sum, nil
+}
+
+// applyConfig 整体替换配置
+func (p *StorageProxy) applyConfig(cfg StorageProxyConfig, sum string) {
+	rand.Seed(time.Now().UnixNano())
+	now := time.Now().Unix()
+
+	p.mutex.Lock()
+	p.config = cfg
+	p.curHostIndex = rand.Intn(len(cfg.StorageHosts))
+	p.reload.Checksum = sum
+	p.reload.LastAttemptAt = now
+	p.reload.LastReloadAt = now
+	p.reload.LastError = ""
+	p.reload.FailedChecksum = ""
+	p.mutex.Unlock()
+
+	task.SetScheduleOrder(cfg.ScheduleOrder)
+	task.SetEndpoint(cfg.LocalHost, cfg.FileServerPort, cfg.Port)
+	task.SetLeaseTTL(cfg.LeaseTTL)
+	task.SetRequestTimeout(cfg.RequestTimeout)
+	task.SetRetryPolicy(task.RetryPolicy{
+		StallTimeout: cfg.StallTimeout,
+		MaxRetries:   cfg.RetryMax,
+		BackoffBase:  cfg.RetryBackoffBase,
+		BackoffMax:   cfg.RetryBackoffMax,
+		OtherHost:    cfg.RetryOtherHost,
+		Hosts:        cfg.StorageHosts,
+	})
+}
+
+// reloadConfig 配置文件变更后重新加载, 不合法的配置不生效, 也不会修改配置文件
+// force 为 true 时即使配置文件未变更也重新加载, 用于 SIGHUP
+func (p *StorageProxy) reloadConfig(cfgFile string, force bool) error {
+	cfg, sum, err := loadConfig(cfgFile, p.flags)
+
+	p.mutex.Lock()
+	if !force && sum != "" && sum == p.reload.Checksum {
+		// 改回了当前生效的配置
+		p.reload.LastError = ""
+		p.reload.FailedChecksum = ""
+		p.mutex.Unlock()
+		return nil
+	}
+	failed := !force && sum != "" && sum == p.reload.FailedChecksum
+	p.mutex.Unlock()
+	if failed {
+		return nil
+	}
+
+	if err != nil {
+		p.mutex.Lock()
+		p.reload.LastAttemptAt = time.Now().Unix()
+		p.reload.LastError = err.Error()
+		p.reload.FailedChecksum = sum
+		p.mutex.Unlock()
+		return err
+	}
+
+	// 先绑定新端口, 失败时保留当前配置
+	if err := p.rebind(cfg); err != nil {
+		p.mutex.Lock()
+		p.reload.LastAttemptAt = time.Now().Unix()
+		p.reload.LastError = err.Error()
+		p.reload.FailedChecksum = sum
+		p.mutex.Unlock()
+		return err
+	}
+
+	p.applyConfig(cfg, sum)
+	log.Infof(log.Fields{}, "config file %v reloaded, storage hosts %v", cfgFile, cfg.StorageHosts)
+	return nil
+}
+
+// snapshot 返回当前配置, 配置只会整体替换, 调用方在一次处理中应使用同一份
+func (p *StorageProxy) snapshot() StorageProxyConfig {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.config
+}
+
+// nextHost 轮询选择存储节点
+func (p *StorageProxy) nextHost(cfg StorageProxyConfig) string {
+	if cfg.LocalPlot {
+		return cfg.LocalHost
+	}
+
+	p.mutex.Lock()
+	selectedHostIndex := p.curHostIndex % len(cfg.StorageHosts)
+	p.curHostIndex = (selectedHostIndex + 1) % len(cfg.StorageHosts)
+	p.mutex.Unlock()
+	return cfg.StorageHosts[selectedHostIndex]
+}
+
+// watcherCfgFile 监测配置文件变更
+func (p *StorageProxy) watcherCfgFile(cfgFile string) {
+	tick := time.NewTicker(cfgWatchInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if err := p.reloadConfig(cfgFile, false); err != nil {
+				log.Errorf(log.Fields{}, "keep current config, cannot reload %v: %v", cfgFile, err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *StorageProxy) ConfigStatusRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.reload, "", 0
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix 环境变量前缀, 字段名为 json 标签的大写, 例如 SPACEMESH_PROXY_STORAGE_HOSTS
+const EnvPrefix = "SPACEMESH_PROXY_"
+
+// unmarshalConfig 按扩展名解析 yaml, toml 或 json
+func unmarshalConfig(cfgFile string, buf []byte, cfg *StorageProxyConfig) error {
+	switch strings.ToLower(filepath.Ext(cfgFile)) {
+	case ".yaml", ".yml":
+		return yaml.UnmarshalStrict(buf, cfg)
+	case ".toml":
+		meta, err := toml.Decode(string(buf), cfg)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown fields %v", undecoded)
+		}
+		return nil
+	default:
+		return decodeJSON(buf, cfg)
+	}
+}
+
+// decodeJSON 与 yaml, toml 一致, 拒绝未知字段
+func decodeJSON(buf []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("unexpected data after config")
+	}
+	return nil
+}
+
+// configKeys 返回所有配置项的 json 标签
+func configKeys() []string {
+	keys := []string{}
+	t := reflect.TypeOf(StorageProxyConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		keys = append(keys, strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+	}
+	return keys
+}
+
+// envOverrides 读取设置了的环境变量
+func envOverrides() map[string]string {
+	overrides := map[string]string{}
+	for _, key := range configKeys() {
+		if v, ok := os.LookupEnv(EnvPrefix + strings.ToUpper(key)); ok {
+			overrides[key] = v
+		}
+	}
+	return overrides
+}
+
+// overrideConfig 按 json 标签覆盖配置项, 列表以逗号分隔, 结构体列表为 JSON
+func overrideConfig(cfg *StorageProxyConfig, overrides map[string]string) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		s, ok := overrides[key]
+		if !ok {
+			continue
+		}
+
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(s)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("invalid %v: %v", key, err)
+			}
+			f.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("invalid %v: %v", key, err)
+			}
+			f.SetInt(int64(n))
+		case reflect.Float64:
+			n, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %v: %v", key, err)
+			}
+			f.SetFloat(n)
+		case reflect.Slice:
+			// 结构体列表 (如 webhooks) 以 JSON 指定
+			if f.Type().Elem().Kind() != reflect.String {
+				if err := decodeJSON([]byte(s), f.Addr().Interface()); err != nil {
+					return fmt.Errorf("invalid %v: %v", key, err)
+				}
+				continue
+			}
+			items := []string{}
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			f.Set(reflect.ValueOf(items))
+		default:
+			return fmt.Errorf("cannot override %v of kind %v", key, f.Kind())
+		}
+	}
+	return nil
+}
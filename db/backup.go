@@ -0,0 +1,49 @@
+package db
+
+import (
+	"io"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// Backup 在只读事务中写出一致的数据库快照, 期间不阻塞写入, 数据库不会被压缩
+func Backup(w io.Writer) (int64, error) {
+	stateLock.Lock()
+	backups++
+	stateLock.Unlock()
+	defer func() {
+		stateLock.Lock()
+		backups--
+		stateLock.Unlock()
+	}()
+
+	var n int64
+	err := View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// BackupFile 写入临时文件后重命名, 不会留下不完整的备份
+func BackupFile(path string) (int64, error) {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := Backup(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if _err := f.Close(); err == nil {
+		err = _err
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return n, err
+	}
+	return n, os.Rename(tmp, path)
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"errors"
 	"sync"
 	"time"
 
@@ -8,48 +9,141 @@ import (
 )
 
 var (
-	DefaultBucket = []byte("spacemesh")
-	DefaultDB     = "/etc/spacemesh-storage-proxy.db"
+	// 数据库版本等元数据
+	MetaBucket = []byte("meta")
+	// 文件传输任务, 以本地文件路径为键
+	TaskBucket = []byte("tasks")
+	// 任务的二级索引, 与任务在同一个事务中更新
+	TaskStatusIndex = []byte("tasks_by_status")
+	TaskHostIndex   = []byte("tasks_by_host")
+	TaskDirIndex    = []byte("tasks_by_dir")
+	// NewPlotRequest 登记的目录任务
+	JobBucket = []byte("jobs")
+	// 存储节点
+	HostBucket = []byte("hosts")
+	// 只追加的事件记录, 键为 8 字节的序号
+	EventBucket = []byte("events")
+	// 事件按任务路径及目录的索引
+	EventPathIndex = []byte("events_by_path")
+	EventDirIndex  = []byte("events_by_dir")
+	// 归档的已完成或失败的任务, 键为 归档时间 + 本地文件路径
+	HistoryBucket = []byte("history")
+	// 索引失败的目录
+	QuarantineBucket = []byte("quarantine")
+	// 运维指定的目录优先级
+	PriorityBucket = []byte("priority")
+	// PoST 目录传输到的位置, 以 NodeID + 本地目录为键, 不清理
+	PlacementBucket = []byte("placements")
+
+	DefaultDB = "/etc/spacemesh-storage-proxy.db"
 )
 
+var buckets = [][]byte{
+	MetaBucket,
+	TaskBucket,
+	TaskStatusIndex,
+	TaskHostIndex,
+	TaskDirIndex,
+	JobBucket,
+	HostBucket,
+	EventBucket,
+	EventPathIndex,
+	EventDirIndex,
+	HistoryBucket,
+	QuarantineBucket,
+	PriorityBucket,
+	PlacementBucket,
+}
+
+// ErrClosed Close 之后不再打开数据库, 停止期间退出较晚的任务不会重新打开文件
+var ErrClosed = errors.New("database closed")
+
 var (
-	dbpath     string
-	boltClient sync.Map
-	lock       sync.Mutex
+	dbpath string
+	client *bolt.DB
+	closed bool
+	// 事务期间持有读锁, 打开、压缩及关闭数据库时持有写锁
+	lock sync.RWMutex
 )
 
 func InitBoltClient(path string) {
 	if path == "" {
 		path = DefaultDB
 	}
+	lock.Lock()
 	dbpath = path
+	closed = false
+	lock.Unlock()
 }
 
-func BoltClient() (*bolt.DB, error) {
-	return _boltClient(dbpath)
+// Open 打开数据库, 之后的事务不再等待打开
+func Open() error {
+	unlock, err := acquire()
+	if err != nil {
+		return err
+	}
+	unlock()
+	return nil
 }
 
-func _boltClient(path string) (*bolt.DB, error) {
-	// Open the my.db data file in your current directory.
-	// It will be created if it doesn't exist.
-	if db, ok := boltClient.Load("bolt"); ok {
-		return db.(*bolt.DB), nil
+// View 在只读事务中执行 fn, 数据库压缩期间等待
+func View(fn func(tx *bolt.Tx) error) error {
+	unlock, err := acquire()
+	if err != nil {
+		return err
 	}
+	defer unlock()
+	return client.View(fn)
+}
 
-	lock.Lock()
-	defer lock.Unlock()
-	db, err := open(path)
+// Update 在读写事务中执行 fn, 数据库压缩期间等待
+func Update(fn func(tx *bolt.Tx) error) error {
+	unlock, err := acquire()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer unlock()
+	return client.Update(fn)
+}
 
-	boltClient.Store("bolt", db)
-	return db, nil
+// acquire 持有读锁返回, 数据库未打开时先打开
+func acquire() (func(), error) {
+	lock.RLock()
+	if client != nil {
+		return lock.RUnlock, nil
+	}
+	lock.RUnlock()
+
+	lock.Lock()
+	if closed {
+		lock.Unlock()
+		return nil, ErrClosed
+	}
+	if client == nil {
+		// Open the my.db data file in your current directory.
+		// It will be created if it doesn't exist.
+		db, err := open(dbpath)
+		if err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+		client = db
+	}
+	lock.Unlock()
+	return acquire()
 }
 
-// TODO
+// Close 等待正在执行的事务完成后关闭数据库, 之后的事务返回 ErrClosed
 func Close() error {
-	return nil
+	lock.Lock()
+	defer lock.Unlock()
+	closed = true
+	if client == nil {
+		return nil
+	}
+	db := client
+	client = nil
+	return db.Close()
 }
 
 func open(path string) (*bolt.DB, error) {
@@ -57,10 +151,19 @@ func open(path string) (*bolt.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 	if err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(DefaultBucket)
-		return err
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
 	}); err != nil {
+		db.Close()
 		return nil, err
 	}
 
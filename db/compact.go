@@ -0,0 +1,140 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// CompactFreeRatio 空闲页占文件的比例超过该值时才压缩
+	CompactFreeRatio = 0.2
+	// CompactMinSize 小于该值的文件不压缩
+	CompactMinSize = 1 << 20
+)
+
+// ErrBackupRunning 有备份正在进行时不压缩, 避免压缩等待备份期间阻塞所有事务
+var ErrBackupRunning = errors.New("backup in progress")
+
+var (
+	// 正在进行的备份数, 压缩期间开始的备份等待压缩完成
+	backups   int
+	stateLock sync.Mutex
+)
+
+// Usage 返回数据库文件大小及空闲页的比例
+func Usage() (int64, float64, error) {
+	unlock, err := acquire()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+	size, err := fileSize(client.Path())
+	if err != nil || size == 0 {
+		return size, 0, err
+	}
+	stats := client.Stats()
+	return size, float64((stats.FreePageN+stats.PendingPageN)*client.Info().PageSize) / float64(size), nil
+}
+
+// Compact 将数据库复制到新文件并替换, 回收删除数据后的空间
+// 等待正在执行的事务完成, 期间新的事务等待压缩完成; 有备份正在进行时返回 ErrBackupRunning
+func Compact() (int64, int64, error) {
+	// 持有 stateLock 直到取得写锁, 之后开始的备份等待压缩完成
+	stateLock.Lock()
+	if backups > 0 {
+		stateLock.Unlock()
+		return 0, 0, ErrBackupRunning
+	}
+	lock.Lock()
+	stateLock.Unlock()
+	defer lock.Unlock()
+	if closed {
+		return 0, 0, ErrClosed
+	}
+
+	if client != nil {
+		db := client
+		client = nil
+		if err := db.Close(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	before, err := fileSize(dbpath)
+	if err != nil {
+		return 0, 0, err
+	}
+	tmp := dbpath + ".compact"
+	os.Remove(tmp)
+	if err := compactTo(dbpath, tmp); err != nil {
+		os.Remove(tmp)
+		// 原有的文件未变更, 由下一个事务重新打开
+		return before, before, err
+	}
+	if err := os.Rename(tmp, dbpath); err != nil {
+		os.Remove(tmp)
+		return before, before, err
+	}
+
+	after, err := fileSize(dbpath)
+	if err != nil {
+		return before, 0, err
+	}
+	client, err = open(dbpath)
+	return before, after, err
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func compactTo(src, dst string) error {
+	sdb, err := bolt.Open(src, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer sdb.Close()
+	ddb, err := bolt.Open(dst, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer ddb.Close()
+
+	return sdb.View(func(stx *bolt.Tx) error {
+		// 每个 bucket 一个事务
+		return stx.ForEach(func(name []byte, sbk *bolt.Bucket) error {
+			return ddb.Update(func(dtx *bolt.Tx) error {
+				dbk, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(sbk, dbk)
+			})
+		})
+	})
+}
+
+func copyBucket(src, dst *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	// 按顺序写入时填满页
+	dst.FillPercent = 1
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		sub, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(src.Bucket(k), sub)
+	})
+}
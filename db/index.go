@@ -0,0 +1,137 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+)
+
+// 索引的键为 索引值 + 0 + 本地文件路径, 值为空, 按前缀遍历同一索引值的任务
+const indexSep = 0
+
+func indexKey(value []byte, path string) []byte {
+	key := make([]byte, 0, len(value)+1+len(path))
+	key = append(key, value...)
+	key = append(key, indexSep)
+	return append(key, path...)
+}
+
+func statusValue(status uint8) []byte {
+	return []byte{status}
+}
+
+// PutTaskIndex 添加任务的索引
+func PutTaskIndex(tx *bolt.Tx, path string, status uint8, host string) error {
+	if err := tx.Bucket(TaskStatusIndex).Put(indexKey(statusValue(status), path), []byte{}); err != nil {
+		return err
+	}
+	if err := tx.Bucket(TaskHostIndex).Put(indexKey([]byte(host), path), []byte{}); err != nil {
+		return err
+	}
+	return tx.Bucket(TaskDirIndex).Put(indexKey([]byte(filepath.Dir(path)), path), []byte{})
+}
+
+// DeleteTaskIndex 删除任务的索引
+func DeleteTaskIndex(tx *bolt.Tx, path string, status uint8, host string) error {
+	if err := tx.Bucket(TaskStatusIndex).Delete(indexKey(statusValue(status), path)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(TaskHostIndex).Delete(indexKey([]byte(host), path)); err != nil {
+		return err
+	}
+	return tx.Bucket(TaskDirIndex).Delete(indexKey([]byte(filepath.Dir(path)), path))
+}
+
+func scanIndex(bk *bolt.Bucket, value []byte, fn func(path string) error) error {
+	prefix := indexKey(value, "")
+	c := bk.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if err := fn(string(k[len(prefix):])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanTaskStatus 按路径顺序遍历状态为 status 的任务
+func ScanTaskStatus(tx *bolt.Tx, status uint8, fn func(path string) error) error {
+	return scanIndex(tx.Bucket(TaskStatusIndex), statusValue(status), fn)
+}
+
+// ScanTaskHost 按路径顺序遍历分配到 host 的任务
+func ScanTaskHost(tx *bolt.Tx, host string, fn func(path string) error) error {
+	return scanIndex(tx.Bucket(TaskHostIndex), []byte(host), fn)
+}
+
+// ScanTaskDir 按路径顺序遍历 dir 目录下的任务, 不包含子目录
+func ScanTaskDir(tx *bolt.Tx, dir string, fn func(path string) error) error {
+	return scanIndex(tx.Bucket(TaskDirIndex), []byte(dir), fn)
+}
+
+// PlacementKey PoST 目录去向的键, 按 NodeID 前缀遍历同一节点的目录
+func PlacementKey(nodeID, dir string) []byte {
+	return indexKey([]byte(nodeID), dir)
+}
+
+// EventKey 事件记录的键, 8 字节大端序的序号
+func EventKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// AppendEvent 在 tx 中追加一条事件记录及其索引, 返回分配的序号
+func AppendEvent(tx *bolt.Tx, b []byte, path, dir string) (uint64, error) {
+	bk := tx.Bucket(EventBucket)
+	seq, err := bk.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	key := EventKey(seq)
+	if err := bk.Put(key, b); err != nil {
+		return 0, err
+	}
+	return seq, PutEventIndex(tx, key, path, dir)
+}
+
+// PutEventIndex 添加事件的路径及目录索引, 为空时不索引
+func PutEventIndex(tx *bolt.Tx, seq []byte, path, dir string) error {
+	if path != "" {
+		if err := tx.Bucket(EventPathIndex).Put(indexKey([]byte(path), string(seq)), []byte{}); err != nil {
+			return err
+		}
+	}
+	if dir != "" {
+		return tx.Bucket(EventDirIndex).Put(indexKey([]byte(dir), string(seq)), []byte{})
+	}
+	return nil
+}
+
+// DeleteEventIndex 删除事件的索引
+func DeleteEventIndex(tx *bolt.Tx, seq []byte, path, dir string) error {
+	if path != "" {
+		if err := tx.Bucket(EventPathIndex).Delete(indexKey([]byte(path), string(seq))); err != nil {
+			return err
+		}
+	}
+	if dir != "" {
+		return tx.Bucket(EventDirIndex).Delete(indexKey([]byte(dir), string(seq)))
+	}
+	return nil
+}
+
+// ScanEventPath 按序号遍历任务 path 的事件
+func ScanEventPath(tx *bolt.Tx, path string, fn func(seq []byte) error) error {
+	return scanIndex(tx.Bucket(EventPathIndex), []byte(path), func(seq string) error {
+		return fn([]byte(seq))
+	})
+}
+
+// ScanEventDir 按序号遍历目录 dir 的事件, 包含目录中任务的事件
+func ScanEventDir(tx *bolt.Tx, dir string, fn func(seq []byte) error) error {
+	return scanIndex(tx.Bucket(EventDirIndex), []byte(dir), func(seq string) error {
+		return fn([]byte(seq))
+	})
+}
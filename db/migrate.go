@@ -0,0 +1,251 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/boltdb/bolt"
+)
+
+// migration 将数据库从 Version-1 升级到 Version, 在同一个事务中执行
+type migration struct {
+	Version int
+	Name    string
+	Migrate func(tx *bolt.Tx) error
+}
+
+var migrations = []migration{
+	{1, "split buckets per entity and key tasks by local path", migrateV1},
+	{2, "index tasks by status, host and directory", migrateV2},
+	{3, "key placements by node id and directory", migrateV3},
+}
+
+// SchemaVersion 当前代码对应的数据库版本
+var SchemaVersion = migrations[len(migrations)-1].Version
+
+var schemaVersionKey = []byte("schema_version")
+
+// Version 返回数据库的版本, 未记录版本的数据库为 0
+func Version(tx *bolt.Tx) int {
+	bk := tx.Bucket(MetaBucket)
+	if bk == nil {
+		return 0
+	}
+	v := bk.Get(schemaVersionKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+func setVersion(tx *bolt.Tx, version int) error {
+	bk, err := tx.CreateBucketIfNotExists(MetaBucket)
+	if err != nil {
+		return err
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(version))
+	return bk.Put(schemaVersionKey, v)
+}
+
+// migrate 依次执行未执行过的升级
+func migrate(db *bolt.DB) error {
+	version := 0
+	if err := db.View(func(tx *bolt.Tx) error {
+		version = Version(tx)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("database schema version %v is newer than supported %v", version, SchemaVersion)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		log.Infof(log.Fields{}, "migrate database to version %v: %v", m.Version, m.Name)
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if err := m.Migrate(tx); err != nil {
+				return err
+			}
+			return setVersion(tx, m.Version)
+		}); err != nil {
+			return fmt.Errorf("fail to migrate database to version %v: %v", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// 版本 0 的数据库
+var (
+	legacyTaskBucket = []byte("spacemesh")
+	legacyJobBucket  = []byte("job")
+	// 与 task.PlotFilePrefix 相同, 升级逻辑不随之变更
+	legacyPlotFilePrefix = "/plotfile"
+)
+
+// legacyPath 从 PlotURL 中取出本地文件路径
+func legacyPath(plotURL string) string {
+	u, err := url.Parse(plotURL)
+	if err != nil {
+		return ""
+	}
+	if !strings.HasPrefix(u.Path, legacyPlotFilePrefix+"/") {
+		return ""
+	}
+	return strings.TrimPrefix(u.Path, legacyPlotFilePrefix)
+}
+
+// migrateV1 版本 0 的任务都在 spacemesh 中, 以 PlotURL 为键, 修改 host 或 file_server_port 后无法找到,
+// 移动到 tasks 中并以本地文件路径为键, 同时将 job 重命名为 jobs
+func migrateV1(tx *bolt.Tx) error {
+	if legacy := tx.Bucket(legacyTaskBucket); legacy != nil {
+		tasks, err := tx.CreateBucketIfNotExists(TaskBucket)
+		if err != nil {
+			return err
+		}
+		if err := legacy.ForEach(func(k, v []byte) error {
+			path := legacyPath(string(k))
+			if path == "" {
+				log.Errorf(log.Fields{}, "drop task with invalid plot url %v", string(k))
+				return nil
+			}
+			rec := map[string]interface{}{}
+			dec := json.NewDecoder(bytes.NewReader(v))
+			dec.UseNumber()
+			if err := dec.Decode(&rec); err != nil {
+				log.Errorf(log.Fields{}, "drop invalid task %v: %v", string(k), err)
+				return nil
+			}
+			rec["path"] = path
+			b, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			return tasks.Put([]byte(path), b)
+		}); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket(legacyTaskBucket); err != nil {
+			return err
+		}
+	}
+
+	if legacy := tx.Bucket(legacyJobBucket); legacy != nil {
+		jobs, err := tx.CreateBucketIfNotExists(JobBucket)
+		if err != nil {
+			return err
+		}
+		if err := legacy.ForEach(func(k, v []byte) error {
+			return jobs.Put(k, v)
+		}); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket(legacyJobBucket); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateV2 按已有的任务重建二级索引
+func migrateV2(tx *bolt.Tx) error {
+	for _, name := range [][]byte{TaskStatusIndex, TaskHostIndex, TaskDirIndex} {
+		if tx.Bucket(name) != nil {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+
+	tasks := tx.Bucket(TaskBucket)
+	if tasks == nil {
+		return nil
+	}
+	return tasks.ForEach(func(k, v []byte) error {
+		rec := struct {
+			Status uint8  `json:"status"`
+			Host   string `json:"host"`
+		}{}
+		if err := json.Unmarshal(v, &rec); err != nil {
+			log.Errorf(log.Fields{}, "skip index of invalid task %v: %v", string(k), err)
+			return nil
+		}
+		return PutTaskIndex(tx, string(k), rec.Status, rec.Host)
+	})
+}
+
+// migrateV3 版本 2 的 placement 以 NodeID 为键, 同一节点的第二个目录会覆盖第一个,
+// 改为 NodeID + 本地目录, 存储节点记录在每个文件中, 目录汇总为 hosts
+func migrateV3(tx *bolt.Tx) error {
+	bk := tx.Bucket(PlacementBucket)
+	if bk == nil {
+		return nil
+	}
+
+	type placement struct {
+		key   []byte
+		value []byte
+	}
+	placements := []placement{}
+	if err := bk.ForEach(func(k, v []byte) error {
+		rec := map[string]interface{}{}
+		if err := json.Unmarshal(v, &rec); err != nil {
+			log.Errorf(log.Fields{}, "skip invalid placement %v: %v", string(k), err)
+			return nil
+		}
+		nodeID, _ := rec["node_id"].(string)
+		dir, _ := rec["local_path"].(string)
+		hosts := map[string]struct{}{}
+		files, _ := rec["files"].([]interface{})
+		for _, f := range files {
+			file, _ := f.(map[string]interface{})
+			if host, _ := file["host"].(string); host != "" {
+				hosts[host] = struct{}{}
+			}
+		}
+		sorted := []string{}
+		for host := range hosts {
+			sorted = append(sorted, host)
+		}
+		sort.Strings(sorted)
+		rec["hosts"] = sorted
+		delete(rec, "host")
+		delete(rec, "remote_path")
+
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		placements = append(placements, placement{PlacementKey(nodeID, dir), b})
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := tx.DeleteBucket(PlacementBucket); err != nil {
+		return err
+	}
+	bk, err := tx.CreateBucket(PlacementBucket)
+	if err != nil {
+		return err
+	}
+	for _, p := range placements {
+		if err := bk.Put(p.key, p.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
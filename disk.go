@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+)
+
+const (
+	DefaultDiskPausePercent = 5
+	DefaultDiskDrainPercent = 10
+
+	diskCheckInterval = 30 * time.Second
+	diskCheckTimeout  = 10 * time.Second
+)
+
+var (
+	diskFreeBytes   = metrics.NewGauge("spacemesh_proxy_disk_free_bytes", "Free bytes of the plot path disk", "path")
+	diskTotalBytes  = metrics.NewGauge("spacemesh_proxy_disk_total_bytes", "Total bytes of the plot path disk", "path")
+	diskFreeInodes  = metrics.NewGauge("spacemesh_proxy_disk_free_inodes", "Free inodes of the plot path disk", "path")
+	diskTotalInodes = metrics.NewGauge("spacemesh_proxy_disk_total_inodes", "Total inodes of the plot path disk", "path")
+	diskHealthy     = metrics.NewGauge("spacemesh_proxy_disk_healthy", "Whether the plot path disk is usable", "path")
+	diskAccepting   = metrics.NewGauge("spacemesh_proxy_disk_accepting", "Whether the plot path accepts new plots", "path")
+)
+
+// disks 记录每个 PlotPath 所在磁盘的状态
+type disks struct {
+	status map[string]types.DiskStatus
+	// 正在检查的磁盘, 卡住的检查返回前不再重复检查
+	checking map[string]struct{}
+	mutex    sync.Mutex
+}
+
+func newDisks() *disks {
+	return &disks{
+		status:   map[string]types.DiskStatus{},
+		checking: map[string]struct{}{},
+	}
+}
+
+func (d *disks) startCheck(path string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.checking[path]; ok {
+		return false
+	}
+	d.checking[path] = struct{}{}
+	return true
+}
+
+func (d *disks) doneCheck(path string) {
+	d.mutex.Lock()
+	delete(d.checking, path)
+	d.mutex.Unlock()
+}
+
+func (d *disks) set(s types.DiskStatus) {
+	d.mutex.Lock()
+	prev, ok := d.status[s.Path]
+	d.status[s.Path] = s
+	d.mutex.Unlock()
+
+	// 开始优先传输时通知, 磁盘即将写满
+	if s.Draining && (!ok || !prev.Draining) {
+		event.Publish(event.Event{
+			Type:    event.DiskLow,
+			Dir:     s.Path,
+			Message: fmt.Sprintf("%.1f%% free on %v", s.FreePercent, s.MountPoint),
+			Data:    s,
+		})
+	}
+
+	diskFreeBytes.Set(float64(s.FreeBytes), s.Path)
+	diskTotalBytes.Set(float64(s.TotalBytes), s.Path)
+	diskFreeInodes.Set(float64(s.FreeInodes), s.Path)
+	diskTotalInodes.Set(float64(s.TotalInodes), s.Path)
+	diskHealthy.Set(boolGauge(s.Healthy), s.Path)
+	diskAccepting.Set(boolGauge(s.Accepting), s.Path)
+}
+
+// get 返回 PlotPath 的状态, 尚未检查过时 ok 为 false
+func (d *disks) get(path string) (types.DiskStatus, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s, ok := d.status[path]
+	return s, ok
+}
+
+func (d *disks) list(paths []string) []types.DiskStatus {
+	ss := []types.DiskStatus{}
+	for _, path := range paths {
+		s, ok := d.get(path)
+		if !ok {
+			s = types.DiskStatus{Path: path, Error: "not checked yet"}
+		}
+		ss = append(ss, s)
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].Path < ss[j].Path
+	})
+	return ss
+}
+
+// owner 返回包含 dir 的 PlotPath 状态
+func (d *disks) owner(paths []string, dir string) (types.DiskStatus, bool) {
+	dir = filepath.Clean(dir)
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if dir != path && !strings.HasPrefix(dir, path+string(filepath.Separator)) {
+			continue
+		}
+		return d.get(path)
+	}
+	return types.DiskStatus{}, false
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// mountOf 从 /proc/self/mountinfo 中找到 path 所在的挂载点及是否只读
+func mountOf(path string) (string, bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	mountPoint := ""
+	readOnly := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		mp := fields[4]
+		if path != mp && mp != "/" && !strings.HasPrefix(path, mp+"/") {
+			continue
+		}
+		if len(mp) < len(mountPoint) {
+			continue
+		}
+		mountPoint = mp
+		readOnly = false
+		for _, opt := range strings.Split(fields[5], ",") {
+			if opt == "ro" {
+				readOnly = true
+			}
+		}
+	}
+	return mountPoint, readOnly, scanner.Err()
+}
+
+// checkDisk 检查 PlotPath 是否存在, 是否挂载, 是否只读, 以及空间和 inode 使用情况
+func checkDisk(path string, pausePercent, drainPercent float64) types.DiskStatus {
+	s := types.DiskStatus{
+		Path:      path,
+		CheckedAt: time.Now().Unix(),
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Exists = true
+	if !info.IsDir() {
+		s.Error = fmt.Sprintf("%v is not a directory", path)
+		return s
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.MountPoint, s.ReadOnly, err = mountOf(abs)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Mounted = s.MountPoint != "" && s.MountPoint != "/"
+
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &st); err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.TotalBytes = st.Blocks * uint64(st.Bsize)
+	s.FreeBytes = st.Bavail * uint64(st.Bsize)
+	s.TotalInodes = st.Files
+	s.FreeInodes = st.Ffree
+	if s.TotalBytes > 0 {
+		s.FreePercent = float64(s.FreeBytes) * 100 / float64(s.TotalBytes)
+	}
+	inodePercent := float64(100)
+	if s.TotalInodes > 0 {
+		inodePercent = float64(s.FreeInodes) * 100 / float64(s.TotalInodes)
+	}
+
+	s.Healthy = s.Mounted && !s.ReadOnly
+	switch {
+	case !s.Mounted:
+		// 挂载点丢失时写入会落到根分区
+		s.Error = fmt.Sprintf("%v is not on a mounted disk", s.Path)
+	case s.ReadOnly:
+		s.Error = fmt.Sprintf("%v is read-only", s.MountPoint)
+	}
+	s.Accepting = s.Healthy && s.FreePercent >= pausePercent && inodePercent >= pausePercent
+	s.Draining = s.FreePercent < drainPercent || inodePercent < drainPercent
+	return s
+}
+
+func (p *StorageProxy) diskMonitor() {
+	p.checkDisks()
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkDisks()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// checkDisks 检查所有 PlotPath, 单个磁盘卡住不影响其他磁盘
+func (p *StorageProxy) checkDisks() {
+	cfg := p.snapshot()
+	paths := cfg.PlotPaths
+	pausePercent := cfg.DiskPausePercent
+	drainPercent := cfg.DiskDrainPercent
+
+	if pausePercent <= 0 {
+		pausePercent = DefaultDiskPausePercent
+	}
+	if drainPercent <= 0 {
+		drainPercent = DefaultDiskDrainPercent
+	}
+
+	wg := sync.WaitGroup{}
+	for _, _path := range paths {
+		if !p.disks.startCheck(_path) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(_path string) {
+			defer wg.Done()
+
+			done := make(chan types.DiskStatus, 1)
+			go func() {
+				defer p.disks.doneCheck(_path)
+				done <- checkDisk(_path, pausePercent, drainPercent)
+			}()
+
+			var s types.DiskStatus
+			select {
+			case s = <-done:
+			case <-time.After(diskCheckTimeout):
+				prev, _ := p.disks.get(_path)
+				s = prev
+				s.Path = _path
+				s.Healthy = false
+				s.Accepting = false
+				s.CheckedAt = time.Now().Unix()
+				s.Error = fmt.Sprintf("disk check not finished after %v", diskCheckTimeout)
+			}
+			if !s.Healthy || !s.Accepting {
+				log.Errorf(log.Fields{}, "plot path %v unavailable: %v, free %.2f%%", _path, s.Error, s.FreePercent)
+			}
+			p.disks.set(s)
+		}(_path)
+	}
+	wg.Wait()
+}
+
+// diskFree 返回目录所在 PlotPath 的剩余空间百分比, 供任务调度使用
+func (p *StorageProxy) diskFree(dir string) (float64, bool) {
+	s, ok := p.disks.owner(p.snapshot().PlotPaths, dir)
+	if !ok || s.TotalBytes == 0 {
+		return 0, false
+	}
+	return s.FreePercent, true
+}
+
+// drainOrder 按剩余空间从少到多排序, 快满的磁盘优先处理
+func (p *StorageProxy) drainOrder(paths []string) []string {
+	sorted := append([]string{}, paths...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		si, oki := p.disks.get(sorted[i])
+		sj, okj := p.disks.get(sorted[j])
+		if !oki || !okj {
+			return oki
+		}
+		if si.Draining != sj.Draining {
+			return si.Draining
+		}
+		return si.FreePercent < sj.FreePercent
+	})
+	return sorted
+}
+
+func (p *StorageProxy) DiskStatusRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	return types.DiskStatusOutput{
+		Disks: p.disks.list(p.snapshot().PlotPaths),
+	}, "", 0
+}
@@ -0,0 +1,177 @@
+package event
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+)
+
+// 事件类型
+const (
+	// 任务状态变更
+	TaskTransition = "task.transition"
+	// 重试次数用完, 任务标记为 error
+	TaskExhausted = "task.retries_exhausted"
+	// 目录任务完成或失败
+	DirCompleted = "dir.completed"
+	DirFailed    = "dir.failed"
+	// 目录传输完成后从本地清理
+	DirCleaned = "dir.cleaned"
+	// 存储节点通知失败或恢复
+	HostDown = "host.down"
+	HostUp   = "host.up"
+	// 磁盘剩余空间低于 disk_drain_percent
+	DiskLow = "disk.low"
+	// 文件的发送进度, 每 5 秒一次, 不记录到数据库
+	TaskProgress = "task.progress"
+)
+
+// Types 返回所有事件类型
+func Types() []string {
+	return []string{TaskTransition, TaskExhausted, TaskProgress, DirCompleted, DirFailed, DirCleaned, HostDown, HostUp, DiskLow}
+}
+
+// Ephemeral 频繁的事件只用于实时推送, 不记录, 只有明确指定类型时才投递到 webhook
+func Ephemeral(typ string) bool {
+	return typ == TaskProgress
+}
+
+// Match 事件类型是否符合过滤条件, 条件为空时全部符合, "task.*" 匹配前缀
+// Ephemeral 的事件只匹配完整的类型名
+func Match(filters []string, typ string) bool {
+	if len(filters) == 0 {
+		return !Ephemeral(typ)
+	}
+	for _, f := range filters {
+		if f == typ {
+			return true
+		}
+		if Ephemeral(typ) {
+			continue
+		}
+		if f == "*" {
+			return true
+		}
+		if strings.HasSuffix(f, ".*") && strings.HasPrefix(typ, strings.TrimSuffix(f, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid 过滤条件是否对应已知的事件类型
+func Valid(filter string) bool {
+	for _, typ := range Types() {
+		if Match([]string{filter}, typ) {
+			return true
+		}
+	}
+	return false
+}
+
+type Event struct {
+	ID string `json:"id"`
+	// 事件记录中的序号, 已写入事件记录时不为 0
+	Seq  uint64 `json:"seq,omitempty"`
+	Type string `json:"type"`
+	Time int64  `json:"time"`
+	// 任务的本地文件, 所属目录及存储节点
+	Path string `json:"path,omitempty"`
+	Dir  string `json:"dir,omitempty"`
+	Host string `json:"host,omitempty"`
+	// 状态变更前后的状态
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// 发起者 (queue, storage, api, watchdog, retry, dispatcher) 及其地址
+	Actor   string      `json:"actor,omitempty"`
+	Remote  string      `json:"remote,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+var subscribers = struct {
+	fns  map[uint64]func(Event)
+	next uint64
+	lock sync.RWMutex
+}{fns: map[uint64]func(Event){}}
+
+// Subscribe 订阅所有事件, 在发布者的 goroutine 中同步调用, 不能阻塞
+// 返回取消订阅的函数
+func Subscribe(fn func(Event)) func() {
+	subscribers.lock.Lock()
+	id := subscribers.next
+	subscribers.next++
+	subscribers.fns[id] = fn
+	subscribers.lock.Unlock()
+
+	return func() {
+		subscribers.lock.Lock()
+		delete(subscribers.fns, id)
+		subscribers.lock.Unlock()
+	}
+}
+
+var recorder = struct {
+	fn   func(Event) (uint64, error)
+	lock sync.RWMutex
+}{}
+
+// SetRecorder 设置事件记录, Publish 在通知订阅者之前记录非 Ephemeral 且 Seq 为 0 的事件
+// fn 返回事件记录中的序号, 订阅者收到的事件带有该序号
+func SetRecorder(fn func(Event) (uint64, error)) {
+	recorder.lock.Lock()
+	recorder.fn = fn
+	recorder.lock.Unlock()
+}
+
+// NewID 返回随机的事件 ID
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Publish 补全 ID 及时间, 记录后通知订阅者, 记录失败时仍通知, Seq 为 0
+func Publish(ev Event) {
+	if ev.ID == "" {
+		ev.ID = NewID()
+	}
+	if ev.Time == 0 {
+		ev.Time = time.Now().Unix()
+	}
+
+	recorder.lock.RLock()
+	record := recorder.fn
+	recorder.lock.RUnlock()
+	if record != nil && ev.Seq == 0 && !Ephemeral(ev.Type) {
+		if seq, err := record(ev); err == nil {
+			ev.Seq = seq
+		}
+	}
+
+	subscribers.lock.RLock()
+	fns := make([]func(Event), 0, len(subscribers.fns))
+	for _, fn := range subscribers.fns {
+		fns = append(fns, fn)
+	}
+	subscribers.lock.RUnlock()
+	for _, fn := range fns {
+		call(fn, ev)
+	}
+}
+
+func call(fn func(Event), ev Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf(log.Fields{}, "event subscriber of %v panic: %v", ev.Type, fmt.Sprintf("%v\n%s", r, debug.Stack()))
+		}
+	}()
+	fn(ev)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	DefaultEventLimit = 100
+	MaxEventLimit     = 10000
+)
+
+var (
+	eventsRecorded = metrics.NewCounter("spacemesh_proxy_events_recorded_total", "Events appended to the event log", "result")
+	eventsPurged   = metrics.NewCounter("spacemesh_proxy_events_purged_total", "Events removed after event_retention")
+)
+
+// errEventLimit 查询到足够的事件后停止遍历
+var errEventLimit = errors.New("event limit reached")
+
+// recordEvent 追加到事件记录, 并按任务路径及目录索引, 返回序号
+// 由 event.Publish 调用, 不记录 Ephemeral 及已在状态变更的事务中写入的事件
+func recordEvent(ev event.Event) (uint64, error) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		log.Errorf(log.Fields{}, "fail to marshal event %v: %v", ev.ID, err)
+		eventsRecorded.Inc("failed")
+		return 0, err
+	}
+	var seq uint64
+	if err := db.Update(func(tx *bolt.Tx) error {
+		seq, err = db.AppendEvent(tx, b, ev.Path, ev.Dir)
+		return err
+	}); err != nil {
+		log.Errorf(log.Fields{}, "fail to record event %v %v: %v", ev.Type, ev.ID, err)
+		eventsRecorded.Inc("failed")
+		return 0, err
+	}
+	eventsRecorded.Inc("ok")
+	return seq, nil
+}
+
+// EventFilter 查询事件的条件, 为空的条件不过滤
+type EventFilter struct {
+	Path string
+	Dir  string
+	Type string
+	// 只返回序号大于 After 的事件, 用于分页
+	After uint64
+	Since int64
+	Limit int
+}
+
+// listEvents 按序号返回符合条件的事件, 指定 path 或 dir 时按索引查询
+func listEvents(filter EventFilter) ([]types.EventRecord, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultEventLimit
+	}
+	if filter.Limit > MaxEventLimit {
+		filter.Limit = MaxEventLimit
+	}
+
+	records := []types.EventRecord{}
+	err := db.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(db.EventBucket)
+		visit := func(key, v []byte) error {
+			seq := binary.BigEndian.Uint64(key)
+			if seq <= filter.After {
+				return nil
+			}
+			ev := event.Event{}
+			if err := json.Unmarshal(v, &ev); err != nil {
+				log.Errorf(log.Fields{}, "invalid event %v: %v", seq, err)
+				return nil
+			}
+			if filter.Type != "" && !event.Match([]string{filter.Type}, ev.Type) {
+				return nil
+			}
+			if ev.Time < filter.Since {
+				return nil
+			}
+			if filter.Path != "" && filter.Dir != "" && ev.Dir != filter.Dir {
+				return nil
+			}
+			ev.Seq = seq
+			records = append(records, types.EventRecord{Seq: seq, Event: ev})
+			if len(records) >= filter.Limit {
+				return errEventLimit
+			}
+			return nil
+		}
+		byIndex := func(seq []byte) error {
+			v := bk.Get(seq)
+			if v == nil {
+				return nil
+			}
+			return visit(seq, v)
+		}
+		switch {
+		case filter.Path != "":
+			return db.ScanEventPath(tx, filter.Path, byIndex)
+		case filter.Dir != "":
+			return db.ScanEventDir(tx, filter.Dir, byIndex)
+		}
+		c := bk.Cursor()
+		for k, v := c.Seek(db.EventKey(filter.After + 1)); k != nil; k, v = c.Next() {
+			if err := visit(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == errEventLimit {
+		err = nil
+	}
+	return records, err
+}
+
+// purgeEvents 删除早于 retention 的事件, 事件按时间追加, 遇到未过期的即停止
+func purgeEvents(retention time.Duration) (int, error) {
+	before := time.Now().Add(-retention).Unix()
+	purged := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(db.EventBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			ev := event.Event{}
+			if err := json.Unmarshal(v, &ev); err == nil && ev.Time >= before {
+				return nil
+			}
+			if err := db.DeleteEventIndex(tx, k, ev.Path, ev.Dir); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// ListEventRequest 按 path, dir, type 及 since 查询事件, after 为上一页最后的序号
+func (p *StorageProxy) ListEventRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	filter := EventFilter{
+		Path: req.Form.Get("path"),
+		Dir:  req.Form.Get("dir"),
+		Type: req.Form.Get("type"),
+	}
+	if s := req.Form.Get("since"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err.Error(), -1
+		}
+		filter.Since = n
+	}
+	if s := req.Form.Get("after"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, err.Error(), -1
+		}
+		filter.After = n
+	}
+	if s := req.Form.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err.Error(), -1
+		}
+		filter.Limit = n
+	}
+
+	records, err := listEvents(filter)
+	if err != nil {
+		return nil, err.Error(), -2
+	}
+	return types.ListEventOutput{Events: records}, "", 0
+}
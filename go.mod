@@ -3,10 +3,13 @@ module github.com/NpoolSpacemesh/spacemesh-storage-proxy
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/EntropyPool/entropy-logger v0.0.0-20210320022718-3091537e035f
 	github.com/NpoolRD/http-daemon v0.0.0-20210505073728-a1d91b8af9df
 	github.com/NpoolSpacemesh/spacemesh-storage-server v0.1.1-0.20230725112445-49d0f14fc327
 	github.com/boltdb/bolt v1.3.1
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/urfave/cli/v2 v2.3.0
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1
+	gopkg.in/yaml.v2 v2.4.0
 )
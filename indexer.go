@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+)
+
+const (
+	DefaultIndexConcurrency = 4
+	DefaultIndexTimeout     = 30 * 60
+)
+
+// indexers 记录每个 PlotPath 的索引状态
+// 每个 PlotPath 同时只有一个索引协程, 超时后标记为不健康并释放并发名额,
+// 卡住的协程返回前不会再次为该 PlotPath 启动索引
+type indexers struct {
+	paths map[string]*types.PlotPathHealth
+	mutex sync.Mutex
+}
+
+func newIndexers() *indexers {
+	return &indexers{
+		paths: map[string]*types.PlotPathHealth{},
+	}
+}
+
+// start 标记开始索引, 已有索引在运行时返回 false
+func (i *indexers) start(path string) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	h, ok := i.paths[path]
+	if !ok {
+		h = &types.PlotPathHealth{Path: path, Healthy: true}
+		i.paths[path] = h
+	}
+	if h.Running {
+		return false
+	}
+	h.Running = true
+	h.LastIndexAt = time.Now().Unix()
+	return true
+}
+
+// done 索引协程返回
+func (i *indexers) done(path string, err error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	h := i.paths[path]
+	h.Running = false
+	h.LastIndexCost = time.Now().Unix() - h.LastIndexAt
+	h.Healthy = err == nil
+	h.Error = ""
+	if err != nil {
+		h.Error = err.Error()
+	}
+}
+
+// timeout 索引超时, 协程仍在运行
+func (i *indexers) timeout(path string, d time.Duration) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	h := i.paths[path]
+	h.Healthy = false
+	h.Error = fmt.Sprintf("index not finished after %v", d)
+}
+
+// list 返回 paths 中每个 PlotPath 的状态, 尚未索引过的视为健康
+func (i *indexers) list(paths []string) []types.PlotPathHealth {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	hs := []types.PlotPathHealth{}
+	for _, path := range paths {
+		h, ok := i.paths[path]
+		if !ok {
+			hs = append(hs, types.PlotPathHealth{Path: path, Healthy: true})
+			continue
+		}
+		hs = append(hs, *h)
+	}
+	sort.Slice(hs, func(a, b int) bool {
+		return hs[a].Path < hs[b].Path
+	})
+	return hs
+}
+
+func (p *StorageProxy) indexer() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.indexAll()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// indexAll 并发索引所有 PlotPath, 并发数由 IndexConcurrency 限制, 不等待索引完成
+// 上一轮的索引仍在运行的 PlotPath 跳过, 卡住的 PlotPath 不影响其他 PlotPath
+func (p *StorageProxy) indexAll() {
+	cfg := p.snapshot()
+	paths := p.drainOrder(cfg.PlotPaths)
+	concurrency := cfg.IndexConcurrency
+	timeout := time.Duration(cfg.IndexTimeout) * time.Second
+
+	if concurrency <= 0 {
+		concurrency = DefaultIndexConcurrency
+	}
+	if timeout <= 0 {
+		timeout = DefaultIndexTimeout * time.Second
+	}
+
+	sem := make(chan struct{}, concurrency)
+	for _, _path := range paths {
+		if !p.indexers.start(_path) {
+			log.Infof(log.Fields{}, "index of %v still running, skip", _path)
+			continue
+		}
+
+		_path := _path
+		p.spawn(func() {
+			p.indexOne(_path, sem, timeout)
+		})
+	}
+}
+
+// indexOne 取得并发名额后索引, 超时后释放名额, 卡住的协程返回前该 PlotPath 不会再次索引
+func (p *StorageProxy) indexOne(_path string, sem chan struct{}, timeout time.Duration) {
+	select {
+	case sem <- struct{}{}:
+	case <-p.done:
+		p.indexers.done(_path, nil)
+		return
+	}
+	defer func() { <-sem }()
+
+	done := make(chan error, 1)
+	go func() {
+		err := p.indexPath(_path)
+		p.indexers.done(_path, err)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Errorf(log.Fields{}, "fail to index %v: %v", _path, err)
+		}
+	case <-time.After(timeout):
+		p.indexers.timeout(_path, timeout)
+		log.Errorf(log.Fields{}, "index %v timeout after %v, mark unhealthy", _path, timeout)
+	}
+}
+
+func (p *StorageProxy) PlotPathHealthRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	return types.PlotPathHealthOutput{
+		Paths: p.indexers.list(p.snapshot().PlotPaths),
+	}, "", 0
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	log "github.com/EntropyPool/entropy-logger"
 	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
@@ -10,12 +14,50 @@ import (
 	"golang.org/x/xerrors"
 )
 
-func main() {
-	// 任务队列
-	task.NewQueue(100)
-	task.AddCallBack(task.TaskTodo, task.Upload)
-	task.AddCallBack(task.TaskFinish, task.Finsih)
+// cliOverrides 命令行参数以配置项的 json 标签为键
+func cliOverrides(cctx *cli.Context) map[string]string {
+	flags := map[string]string{}
+	for _, name := range []string{"db-path", "host", "port", "file-server-port", "storage-hosts", "plot-paths", "localplot"} {
+		if !cctx.IsSet(name) {
+			continue
+		}
+		key := strings.ReplaceAll(name, "-", "_")
+		switch name {
+		case "storage-hosts", "plot-paths":
+			flags[key] = strings.Join(cctx.StringSlice(name), ",")
+		case "port", "file-server-port":
+			flags[key] = fmt.Sprintf("%v", cctx.Int(name))
+		case "localplot":
+			flags[key] = fmt.Sprintf("%v", cctx.Bool(name))
+		default:
+			flags[key] = cctx.String(name)
+		}
+	}
+	return flags
+}
 
+// openDatabase 打开数据库及任务存储
+func openDatabase(cfg StorageProxyConfig) error {
+	db.InitBoltClient(cfg.DBPath)
+	if err := db.Open(); err != nil {
+		return xerrors.Errorf("cannot open database %v: %v", cfg.DBPath, err)
+	}
+
+	storePath := cfg.TaskStorePath
+	if storePath == "" && cfg.TaskStore == task.StoreSQLite {
+		storePath = cfg.DBPath
+		if storePath == "" {
+			storePath = db.DefaultDB
+		}
+		storePath += ".sqlite"
+	}
+	if err := task.OpenStore(cfg.TaskStore, storePath); err != nil {
+		return xerrors.Errorf("cannot open task store %v: %v", cfg.TaskStore, err)
+	}
+	return nil
+}
+
+func main() {
 	app := &cli.App{
 		Name:                 "spacemesh-storage-proxy",
 		Usage:                "Storage proxy for spacemesh plotter",
@@ -25,26 +67,83 @@ func main() {
 			&cli.StringFlag{
 				Name:  "config",
 				Value: "/etc/spacemesh-storage-proxy.conf",
+				Usage: "config file, json, yaml (.yaml/.yml) or toml (.toml) by extension",
+			},
+			&cli.StringFlag{
+				Name:  "db-path",
+				Usage: "override db_path",
+			},
+			&cli.StringFlag{
+				Name:  "host",
+				Usage: "override host",
+			},
+			&cli.IntFlag{
+				Name:  "port",
+				Usage: "override port",
+			},
+			&cli.IntFlag{
+				Name:  "file-server-port",
+				Usage: "override file_server_port",
+			},
+			&cli.StringSliceFlag{
+				Name:  "storage-hosts",
+				Usage: "override storage_hosts",
+			},
+			&cli.StringSliceFlag{
+				Name:  "plot-paths",
+				Usage: "override plot_paths",
+			},
+			&cli.BoolFlag{
+				Name:  "localplot",
+				Usage: "override localplot",
 			},
 		},
+		Commands: []*cli.Command{
+			exportCommand,
+			importCommand,
+			placementCommand,
+		},
 		Action: func(cctx *cli.Context) error {
 			cfgFile := cctx.String("config")
 
-			proxy := NewStorageProxy(cfgFile)
-			if proxy == nil {
-				return xerrors.Errorf("cannot create storage proxy with %v", cfgFile)
+			proxy, err := NewStorageProxy(cfgFile, cliOverrides(cctx))
+			if err != nil {
+				return xerrors.Errorf("cannot create storage proxy with %v: %v", cfgFile, err)
 			}
 
 			// Init database
-			db.InitBoltClient(proxy.config.DBPath)
+			if err := openDatabase(proxy.config); err != nil {
+				return err
+			}
 
-			err := proxy.Run()
+			// 任务队列
+			task.NewQueue(proxy.config.QueueWorkers, proxy.config.QueueBacklog)
+			task.AddCallBack(task.TaskTodo, task.Upload)
+			task.AddCallBack(task.TaskFinish, task.Finsih)
+
+			err = proxy.Run()
 			if err != nil {
 				return xerrors.Errorf("cannot run storage proxy with %v: %v", cfgFile, err)
 			}
 
-			ch := make(chan int)
-			<-ch
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+			for sig := range sigs {
+				if sig == syscall.SIGHUP {
+					log.Infof(log.Fields{}, "reload config %v", cfgFile)
+					if err := proxy.Reload(); err != nil {
+						log.Errorf(log.Fields{}, "keep current config, cannot reload %v: %v", cfgFile, err)
+					}
+					continue
+				}
+
+				log.Infof(log.Fields{}, "receive %v, shutting down", sig)
+				if err := proxy.Shutdown(); err != nil {
+					return xerrors.Errorf("fail to shutdown storage proxy: %v", err)
+				}
+				log.Infof(log.Fields{}, "storage proxy stopped")
+				break
+			}
 
 			return nil
 		},
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const MetricsHandle = "/metrics"
+
+type kind string
+
+const (
+	gauge   kind = "gauge"
+	counter kind = "counter"
+)
+
+// metric 以 Prometheus 文本格式输出的指标
+type metric struct {
+	name   string
+	help   string
+	kind   kind
+	labels []string
+	values map[string]float64
+	mutex  sync.Mutex
+}
+
+type Gauge struct {
+	*metric
+}
+
+type Counter struct {
+	*metric
+}
+
+var (
+	registry []*metric
+	lock     sync.Mutex
+)
+
+func register(name, help string, k kind, labels []string) *metric {
+	m := &metric{
+		name:   name,
+		help:   help,
+		kind:   k,
+		labels: labels,
+		values: map[string]float64{},
+	}
+	lock.Lock()
+	registry = append(registry, m)
+	lock.Unlock()
+	return m
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{register(name, help, gauge, labels)}
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{register(name, help, counter, labels)}
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.set(v, false, labelValues)
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.set(v, true, labelValues)
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.set(1, true, labelValues)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.set(v, true, labelValues)
+}
+
+// Delete 移除一组标签的值, 例如 PlotPath 从配置中删除后
+func (m *metric) Delete(labelValues ...string) {
+	m.mutex.Lock()
+	delete(m.values, m.key(labelValues))
+	m.mutex.Unlock()
+}
+
+func (m *metric) set(v float64, add bool, labelValues []string) {
+	key := m.key(labelValues)
+	m.mutex.Lock()
+	if add {
+		v += m.values[key]
+	}
+	m.values[key] = v
+	m.mutex.Unlock()
+}
+
+func (m *metric) key(labelValues []string) string {
+	pairs := []string{}
+	for i, l := range m.labels {
+		v := ""
+		if i < len(labelValues) {
+			v = labelValues[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%v=%q", l, v))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metric) write(b *strings.Builder) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(b, "# HELP %v %v\n", m.name, m.help)
+	fmt.Fprintf(b, "# TYPE %v %v\n", m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "" {
+			fmt.Fprintf(b, "%v %v\n", m.name, m.values[k])
+			continue
+		}
+		fmt.Fprintf(b, "%v{%v} %v\n", m.name, k, m.values[k])
+	}
+}
+
+// Handler 输出所有已注册的指标
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b := strings.Builder{}
+		lock.Lock()
+		for _, m := range registry {
+			m.write(&b)
+		}
+		lock.Unlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(b.String()))
+	})
+}
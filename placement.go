@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/task"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+)
+
+// recordPlacement 目录传输完成, 清理前记录每个文件的去向
+// 以 NodeID + 本地目录为键, 同一节点的多个目录分别记录
+func (p *StorageProxy) recordPlacement(placement types.Placement, paths []string) error {
+	cfg := p.snapshot()
+	hosts := map[string]struct{}{}
+	remoteDirs := map[string]struct{}{}
+	for _, path := range paths {
+		meta, err := task.Store().Get(path)
+		if err != nil {
+			return err
+		}
+		f := types.PlacementFile{
+			Name:           filepath.Base(path),
+			Size:           meta.Size,
+			Host:           meta.Host,
+			PlotURL:        meta.PlotURL,
+			RemotePath:     meta.RemotePath,
+			RemoteChecksum: meta.Checksum,
+			FinishedAt:     meta.UpdatedAt,
+		}
+		// 读取整个文件, 只在打开时计算
+		if cfg.PlacementChecksum {
+			if f.Checksum, err = sha256File(path); err != nil {
+				return err
+			}
+		}
+		hosts[meta.Host] = struct{}{}
+		if meta.RemotePath != "" {
+			remoteDirs[filepath.Dir(meta.RemotePath)] = struct{}{}
+		}
+		placement.Files = append(placement.Files, f)
+	}
+	placement.Hosts = []string{}
+	for host := range hosts {
+		placement.Hosts = append(placement.Hosts, host)
+	}
+	sort.Strings(placement.Hosts)
+	// 所有文件在同一个目录时记录目录
+	if len(remoteDirs) == 1 {
+		for dir := range remoteDirs {
+			placement.RemotePath = dir
+		}
+	}
+	placement.TransferredAt = time.Now().Unix()
+
+	log.Infof(log.Fields{}, "node %v dir %v placed at %v", placement.NodeID, placement.LocalPath, placement.Hosts)
+	return task.PutPlacement(placement)
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (p *StorageProxy) ListPlacementRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	placements, err := task.ListPlacements(req.Form.Get("node_id"), req.Form.Get("host"))
+	if err != nil {
+		return nil, err.Error(), -1
+	}
+	return types.ListPlacementOutput{
+		Placements: placements,
+	}, "", 0
+}
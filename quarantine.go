@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	DefaultIndexBackoffBase = 10 * 60
+	DefaultIndexBackoffMax  = 24 * 60 * 60
+)
+
+// quarantine 记录索引失败的目录, 按指数退避暂停扫描, 持久化到 bolt
+type quarantine struct {
+	dirs  map[string]types.QuarantinedDir
+	mutex sync.Mutex
+}
+
+func newQuarantine() *quarantine {
+	return &quarantine{
+		dirs: map[string]types.QuarantinedDir{},
+	}
+}
+
+// load 从数据库加载已有记录
+func (q *quarantine) load() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return db.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(db.QuarantineBucket)
+		return bk.ForEach(func(k, v []byte) error {
+			d := types.QuarantinedDir{}
+			if err := json.Unmarshal(v, &d); err != nil {
+				log.Errorf(log.Fields{}, "invalid quarantine record %v: %v", string(k), err)
+				return nil
+			}
+			q.dirs[string(k)] = d
+			return nil
+		})
+	})
+}
+
+// scannable 目录是否已过退避时间
+func (q *quarantine) scannable(dir string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	d, ok := q.dirs[dir]
+	if !ok {
+		return true
+	}
+	return time.Now().Unix() >= d.NextRetryAt
+}
+
+// fail 记录一次失败, 退避时间为 base * 2^(count-1), 不超过 ceil
+func (q *quarantine) fail(dir string, cause error, base, ceil int) {
+	if base <= 0 {
+		base = DefaultIndexBackoffBase
+	}
+	if ceil <= 0 {
+		ceil = DefaultIndexBackoffMax
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	d := q.dirs[dir]
+	d.Dir = dir
+	d.Count++
+	d.LastError = cause.Error()
+	d.LastFailAt = time.Now().Unix()
+
+	backoff := int64(base)
+	for i := 1; i < d.Count && backoff < int64(ceil); i++ {
+		backoff *= 2
+	}
+	if backoff > int64(ceil) {
+		backoff = int64(ceil)
+	}
+	d.NextRetryAt = d.LastFailAt + backoff
+	q.dirs[dir] = d
+
+	if err := q.persist(d); err != nil {
+		log.Errorf(log.Fields{}, "fail to persist quarantine of %v: %v", dir, err)
+	}
+}
+
+// succeed 索引成功后清除记录
+func (q *quarantine) succeed(dir string) {
+	q.mutex.Lock()
+	_, ok := q.dirs[dir]
+	q.mutex.Unlock()
+	if !ok {
+		return
+	}
+	q.clear([]string{dir})
+}
+
+// list 按下次重试时间排序返回
+func (q *quarantine) list() []types.QuarantinedDir {
+	q.mutex.Lock()
+	dirs := make([]types.QuarantinedDir, 0, len(q.dirs))
+	for _, d := range q.dirs {
+		dirs = append(dirs, d)
+	}
+	q.mutex.Unlock()
+
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].NextRetryAt < dirs[j].NextRetryAt
+	})
+	return dirs
+}
+
+// clear 清除指定目录的记录, dirs 为空时清除全部
+func (q *quarantine) clear(dirs []string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(dirs) == 0 {
+		for dir := range q.dirs {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		delete(q.dirs, dir)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(db.QuarantineBucket)
+		for _, dir := range dirs {
+			if err := bk.Delete([]byte(dir)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (q *quarantine) persist(d types.QuarantinedDir) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.QuarantineBucket).Put([]byte(d.Dir), b)
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/task"
+)
+
+const (
+	DefaultHistoryArchiveAfter = 60 * 60
+	DefaultHistoryRetention    = 30 * 24 * 60 * 60
+	DefaultCompactInterval     = 24 * 60 * 60
+
+	retentionInterval = 10 * time.Minute
+)
+
+var (
+	tasksArchived = metrics.NewCounter("spacemesh_proxy_tasks_archived_total", "Done or failed tasks moved to history")
+	historyPurged = metrics.NewCounter("spacemesh_proxy_history_purged_total", "History records removed after retention")
+	jobsPurged    = metrics.NewCounter("spacemesh_proxy_jobs_purged_total", "Finished plot dir jobs removed after retention")
+	dbCompactions = metrics.NewCounter("spacemesh_proxy_db_compactions_total", "Database compactions", "result")
+	dbSizeBytes   = metrics.NewGauge("spacemesh_proxy_db_size_bytes", "Size of the database file")
+	dbFreePercent = metrics.NewGauge("spacemesh_proxy_db_free_percent", "Percentage of free pages in the database file")
+)
+
+func durationOr(seconds, def int) time.Duration {
+	if seconds <= 0 {
+		seconds = def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// retention 定期归档及清理任务, 空闲页较多时压缩数据库
+func (p *StorageProxy) retention() {
+	lastCompact := time.Now()
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		cfg := p.snapshot()
+		archived, err := task.ArchiveTasks(durationOr(cfg.HistoryArchiveAfter, DefaultHistoryArchiveAfter))
+		if err != nil {
+			log.Errorf(log.Fields{}, "fail to archive tasks: %v", err)
+		}
+		tasksArchived.Add(float64(archived))
+
+		purged, err := task.PurgeHistory(durationOr(cfg.HistoryRetention, DefaultHistoryRetention))
+		if err != nil {
+			log.Errorf(log.Fields{}, "fail to purge history: %v", err)
+		}
+		historyPurged.Add(float64(purged))
+
+		purged, err = task.PurgeJobs(durationOr(cfg.HistoryRetention, DefaultHistoryRetention))
+		if err != nil {
+			log.Errorf(log.Fields{}, "fail to purge jobs: %v", err)
+		}
+		jobsPurged.Add(float64(purged))
+
+		if cfg.EventRetention > 0 {
+			purged, err := purgeEvents(time.Duration(cfg.EventRetention) * time.Second)
+			if err != nil {
+				log.Errorf(log.Fields{}, "fail to purge events: %v", err)
+			}
+			eventsPurged.Add(float64(purged))
+		}
+
+		size, free, err := db.Usage()
+		if err != nil {
+			log.Errorf(log.Fields{}, "fail to check database: %v", err)
+			continue
+		}
+		dbSizeBytes.Set(float64(size))
+		dbFreePercent.Set(free * 100)
+		if size < db.CompactMinSize || free < db.CompactFreeRatio || time.Since(lastCompact) < durationOr(cfg.CompactInterval, DefaultCompactInterval) {
+			continue
+		}
+		if p.compact(free) {
+			lastCompact = time.Now()
+		}
+	}
+}
+
+// compact 有备份正在进行时跳过, 返回 false 由下一轮重试
+func (p *StorageProxy) compact(free float64) bool {
+	log.Infof(log.Fields{}, "compact database, %.1f%% free", free*100)
+	before, after, err := db.Compact()
+	if err == db.ErrBackupRunning {
+		log.Infof(log.Fields{}, "skip compacting database: %v", err)
+		dbCompactions.Inc("skipped")
+		return false
+	}
+	if err != nil {
+		log.Errorf(log.Fields{}, "fail to compact database: %v", err)
+		dbCompactions.Inc("failed")
+		return true
+	}
+	log.Infof(log.Fields{}, "database compacted %v -> %v bytes", before, after)
+	dbCompactions.Inc("ok")
+	dbSizeBytes.Set(float64(after))
+	dbFreePercent.Set(0)
+	return true
+}
+
+func (p *StorageProxy) ListHistoryRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	histories, err := task.ListHistory(req.Form.Get("path"))
+	if err != nil {
+		return nil, err.Error(), -1
+	}
+	return histories, "", 0
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	httpdaemon "github.com/NpoolRD/http-daemon"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/task"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+)
+
+const (
+	DefaultDrainTimeout    = 10 * 60
+	DefaultShutdownTimeout = 60
+)
+
+// router 与 httpdaemon 相同的路由及返回格式
+// httpdaemon 只能在 DefaultServeMux 上监听一次, 端口变更后无法重新绑定
+type router struct {
+	routes []httpdaemon.HttpRouter
+	mutex  sync.RWMutex
+}
+
+func (r *router) RegisterRouter(route httpdaemon.HttpRouter) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, _r := range r.routes {
+		if _r.Location == route.Location && _r.Method == route.Method {
+			return fmt.Errorf("router %v %v already exist", route.Method, route.Location)
+		}
+	}
+	r.routes = append(r.routes, route)
+	return nil
+}
+
+func (r *router) response(w http.ResponseWriter, resp interface{}, msg string, code int) {
+	b, err := json.Marshal(&httpdaemon.ApiResp{
+		Code: code,
+		Msg:  msg,
+		Body: resp,
+	})
+	if err != nil {
+		log.Errorf(log.Fields{}, "fail to marshal response: %v", err)
+		return
+	}
+	w.Write(b)
+}
+
+func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	log.Debugf(log.Fields{}, "request %v %v -> %v", req.RemoteAddr, req.Method, req.URL)
+	if err := req.ParseForm(); err != nil {
+		r.response(w, struct{}{}, err.Error(), -1)
+		return
+	}
+
+	r.mutex.RLock()
+	routes := r.routes
+	r.mutex.RUnlock()
+	for _, route := range routes {
+		if route.Location != req.URL.Path || route.Method != req.Method {
+			continue
+		}
+		resp, msg, code := route.Handler(w, req)
+		r.response(w, resp, msg, code)
+		return
+	}
+
+	r.response(w, struct{}{}, fmt.Sprintf("invalid request %v / %v", req.URL, req.Method), -4)
+}
+
+// listener 可以重新绑定端口的 http 服务
+type listener struct {
+	name    string
+	handler http.Handler
+	port    int
+	server  *http.Server
+	mutex   sync.Mutex
+}
+
+func newListener(name string, handler http.Handler) *listener {
+	return &listener{
+		name:    name,
+		handler: handler,
+	}
+}
+
+// prepare 在新端口上监听, 端口未变更时返回 nil
+func (l *listener) prepare(port int) (net.Listener, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.server != nil && l.port == port {
+		return nil, nil
+	}
+	return net.Listen("tcp", fmt.Sprintf(":%v", port))
+}
+
+// commit 在新的监听上提供服务, 旧的服务等待已有的请求完成后关闭
+func (l *listener) commit(ln net.Listener, port int, drainTimeout time.Duration) {
+	srv := &http.Server{Handler: l.handler}
+	go func() {
+		log.Infof(log.Fields{}, "start %v at %v", l.name, port)
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf(log.Fields{}, "fail to serve %v at %v: %v", l.name, port, err)
+		}
+	}()
+
+	l.mutex.Lock()
+	old, oldPort := l.server, l.port
+	l.server, l.port = srv, port
+	l.mutex.Unlock()
+
+	if old != nil {
+		go func() {
+			log.Infof(log.Fields{}, "%v moved from %v to %v, draining", l.name, oldPort, port)
+			if err := drain(old, drainTimeout); err != nil {
+				log.Errorf(log.Fields{}, "fail to drain %v at %v: %v", l.name, oldPort, err)
+			}
+		}()
+	}
+}
+
+// drain 等待已有的请求完成, 超时后强制关闭
+func drain(srv *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
+}
+
+// shutdown 停止监听, 等待已有的请求完成
+func (l *listener) shutdown(ctx context.Context) error {
+	l.mutex.Lock()
+	srv := l.server
+	l.mutex.Unlock()
+	if srv == nil {
+		return nil
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
+}
+
+func (p *StorageProxy) newListeners() {
+	api := http.NewServeMux()
+	api.Handle("/", p.routes)
+	api.Handle(metrics.MetricsHandle, metrics.Handler())
+	// 直接输出文件内容, 不使用 ApiResp
+	api.HandleFunc(types.BackupAPI, p.BackupHandler)
+	api.HandleFunc(types.ExportAPI, p.ExportHandler)
+	// Server-Sent Events
+	api.HandleFunc(types.EventStreamAPI, p.StreamHandler)
+	p.apiListener = newListener("api server", api)
+
+	files := http.NewServeMux()
+	files.Handle(task.PlotFileHandle, task.ServeProgress(http.StripPrefix(task.PlotFileHandle, http.FileServer(http.Dir("/")))))
+	p.fileListener = newListener("plot file server", files)
+}
+
+// rebind 端口变更时重新监听, 任一端口监听失败时不做任何变更
+func (p *StorageProxy) rebind(cfg StorageProxyConfig) error {
+	drainTimeout := time.Duration(cfg.DrainTimeout) * time.Second
+	if drainTimeout <= 0 {
+		drainTimeout = DefaultDrainTimeout * time.Second
+	}
+
+	p.rebindMutex.Lock()
+	defer p.rebindMutex.Unlock()
+
+	apiLn, err := p.apiListener.prepare(cfg.Port)
+	if err != nil {
+		return err
+	}
+	fileLn, err := p.fileListener.prepare(cfg.FileServerPort)
+	if err != nil {
+		if apiLn != nil {
+			apiLn.Close()
+		}
+		return err
+	}
+
+	if apiLn != nil {
+		p.apiListener.commit(apiLn, cfg.Port, drainTimeout)
+	}
+	if fileLn != nil {
+		p.fileListener.commit(fileLn, cfg.FileServerPort, drainTimeout)
+	}
+	return nil
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,202 +17,258 @@ import (
 	log "github.com/EntropyPool/entropy-logger"
 	httpdaemon "github.com/NpoolRD/http-daemon"
 	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
 	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/task"
 	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
-	"github.com/NpoolSpacemesh/spacemesh-storage-server/api"
-	apitypes "github.com/NpoolSpacemesh/spacemesh-storage-server/types"
-	"github.com/boltdb/bolt"
 )
 
-type StorageProxyConfig struct {
-	DBPath         string   `json:"db_path"`
-	LocalPlot      bool     `json:"localplot"`
-	LocalHost      string   `json:"host"`
-	Port           int      `json:"port"`
-	FileServerPort int      `json:"file_server_port"`
-	StorageHosts   []string `json:"storage_hosts"`
-	PlotPaths      []string `json:"plot_paths"`
-}
-
 type StorageProxy struct {
 	config       StorageProxyConfig
 	curHostIndex int
 	mutex        sync.Mutex
-	scannableAt  map[string]uint32
+	quarantine   *quarantine
+	indexers     *indexers
+	disks        *disks
+	reload       types.ReloadStatus
+	flags        map[string]string
+	routes       *router
+	apiListener  *listener
+	fileListener *listener
+	// 同时只有一次端口重新绑定
+	rebindMutex sync.Mutex
+	// 关闭后停止索引, 磁盘检查及配置监听
+	done     chan struct{}
+	stopOnce sync.Once
+	// 后台任务, 关闭数据库前等待退出
+	background sync.WaitGroup
+	// 等待投递到 webhook 的事件
+	webhooks *webhookQueues
 }
 
-var (
-	_md5 [md5.Size]byte
-)
-
-// watcherCfgFile 监测配置文件变更
-func (p *StorageProxy) watcherCfgFile(cfgFile string) {
-	tick := time.NewTicker(5 * time.Second)
-	defer tick.Stop()
-	for range tick.C {
-		// backup old file
-		backup(cfgFile+".old", p.config)
-		go func() {
-			var err error
-			defer func() {
-				if err != nil {
-					// will auto watch
-					restore(cfgFile, cfgFile+".old")
-				}
-			}()
-
-			cfg := StorageProxyConfig{}
-			buf, err := ioutil.ReadFile(cfgFile)
-			if err != nil {
-				log.Errorf(log.Fields{}, "cannot read config file %v: %v", cfgFile, err)
-				return
-			}
-
-			m5 := md5.Sum(buf)
-			if m5 == _md5 {
-				return
-			}
-			_md5 = m5
-			err = json.Unmarshal(buf, &cfg)
-			if err != nil {
-				log.Errorf(log.Fields{}, "cannot parse config file %v: %v", cfgFile, err)
-				return
-			}
-
-			if cfg.LocalPlot {
-				cfg.LocalHost = "127.0.0.1"
-			}
-			rand.Seed(time.Now().UnixNano())
-			p.mutex.Lock()
-			p.config = cfg
-			p.curHostIndex = rand.Intn(len(cfg.StorageHosts))
-			p.mutex.Unlock()
-			log.Infof(log.Fields{}, "config file %v", p.config.StorageHosts)
-		}()
-	}
-}
-
-// backup 备份
-func backup(dst string, cfg StorageProxyConfig) error {
-	_b, err := json.Marshal(cfg)
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(dst, _b, 0644)
-}
-
-// restore 恢复
-func restore(dst, src string) error {
-	_b, err := ioutil.ReadFile(src)
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(dst, _b, 0644)
-}
-
-func NewStorageProxy(cfgFile string) *StorageProxy {
+// NewStorageProxy flags 为命令行指定的配置项, 以 json 标签为键, 优先于配置文件及环境变量
+func NewStorageProxy(cfgFile string, flags map[string]string) (*StorageProxy, error) {
 	proxy := &StorageProxy{
-		scannableAt: map[string]uint32{},
-	}
-	buf, err := ioutil.ReadFile(cfgFile)
-	if err != nil {
-		log.Errorf(log.Fields{}, "cannot read config file %v: %v", cfgFile, err)
-		return nil
-	}
-
-	err = json.Unmarshal(buf, &proxy.config)
+		quarantine: newQuarantine(),
+		indexers:   newIndexers(),
+		disks:      newDisks(),
+		routes:     &router{},
+		flags:      flags,
+		done:       make(chan struct{}),
+		webhooks:   newWebhookQueues(),
+		reload: types.ReloadStatus{
+			ConfigFile: cfgFile,
+		},
+	}
+
+	cfg, sum, err := loadConfig(cfgFile, flags)
 	if err != nil {
-		log.Errorf(log.Fields{}, "cannot parse config file %v: %v", cfgFile, err)
-		return nil
-	}
-
-	if proxy.config.LocalPlot {
-		proxy.config.LocalHost = "127.0.0.1"
+		log.Errorf(log.Fields{}, "invalid config file %v: %v", cfgFile, err)
+		return nil, err
 	}
-	rand.Seed(time.Now().UnixNano())
-	proxy.curHostIndex = rand.Intn(len(proxy.config.StorageHosts))
+	proxy.applyConfig(cfg, sum)
+	proxy.newListeners()
+	task.SetDiskFree(proxy.diskFree)
 
-	// 监听文件变更
-	go proxy.watcherCfgFile(cfgFile)
-
-	return proxy
+	return proxy, nil
 }
 
-func (p *StorageProxy) serveFile() {
-	http.Handle(task.PlotFileHandle, http.StripPrefix(task.PlotFileHandle, http.FileServer(http.Dir("/"))))
-	for {
-		log.Infof(log.Fields{}, "start file server at %v", p.config.FileServerPort)
-		err := http.ListenAndServe(fmt.Sprintf(":%v", p.config.FileServerPort), nil)
-		if err != nil {
-			log.Errorf(log.Fields{}, "fail to listen plot file server %v: %v", p.config.FileServerPort, err)
-		}
+func (p *StorageProxy) Run() error {
+	if err := p.quarantine.load(); err != nil {
+		return err
 	}
-}
 
-func (p *StorageProxy) Run() error {
-	httpdaemon.RegisterRouter(httpdaemon.HttpRouter{
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
 		Location: types.NewPlotAPI,
 		Handler:  p.NewPlotRequest,
 		Method:   "POST",
 	})
-	httpdaemon.RegisterRouter(httpdaemon.HttpRouter{
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.PlotJobAPI,
+		Handler:  p.PlotJobRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
 		Location: types.FinishPlotAPI,
 		Handler:  p.FinishPlotRequest,
 		Method:   "POST",
 	})
-	httpdaemon.RegisterRouter(httpdaemon.HttpRouter{
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
 		Location: types.FailPlotAPI,
 		Handler:  p.FailPlotRequest,
 		Method:   "POST",
 	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.ConfigStatusAPI,
+		Handler:  p.ConfigStatusRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.ListQuarantineAPI,
+		Handler:  p.ListQuarantineRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.ClearQuarantineAPI,
+		Handler:  p.ClearQuarantineRequest,
+		Method:   "POST",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.PlotPathHealthAPI,
+		Handler:  p.PlotPathHealthRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.DiskStatusAPI,
+		Handler:  p.DiskStatusRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.SetPriorityAPI,
+		Handler:  p.SetPriorityRequest,
+		Method:   "POST",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.ListPriorityAPI,
+		Handler:  p.ListPriorityRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.ListHostAPI,
+		Handler:  p.ListHostRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.ListTaskAPI,
+		Handler:  p.ListTaskRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.CancelTaskAPI,
+		Handler:  p.CancelTaskRequest,
+		Method:   "POST",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.RequeueTaskAPI,
+		Handler:  p.RequeueTaskRequest,
+		Method:   "POST",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.ProgressAPI,
+		Handler:  p.ListProgressRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.ListHistoryAPI,
+		Handler:  p.ListHistoryRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.ListPlacementAPI,
+		Handler:  p.ListPlacementRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.ListEventAPI,
+		Handler:  p.ListEventRequest,
+		Method:   "GET",
+	})
+	p.routes.RegisterRouter(httpdaemon.HttpRouter{
+		Location: types.SaveBackupAPI,
+		Handler:  p.SaveBackupRequest,
+		Method:   "POST",
+	})
 
-	httpdaemon.Run(p.config.Port)
-	go p.serveFile()
-	go p.indexer()
+	if err := p.rebind(p.snapshot()); err != nil {
+		return err
+	}
+	// 监听文件变更
+	p.spawn(func() { p.watcherCfgFile(p.reload.ConfigFile) })
+	p.spawn(p.diskMonitor)
+	p.spawn(p.indexer)
+	// 归档及清理任务, 压缩数据库
+	p.spawn(p.retention)
+	// 定期备份数据库
+	p.spawn(p.backupLoop)
+	// 记录事件, 投递事件到 webhook
+	event.SetRecorder(recordEvent)
+	event.Subscribe(p.enqueueWebhook)
+	p.spawn(p.webhookLoop)
 
 	return nil
 }
 
-func (p *StorageProxy) postPlotFile(file string) error {
-	var err error
-
-	for retries := 0; retries < len(p.config.StorageHosts); retries++ {
-		p.mutex.Lock()
-		selectedHostIndex := p.curHostIndex
-		p.curHostIndex = (p.curHostIndex + 1) % len(p.config.StorageHosts)
-		p.mutex.Unlock()
-		host := p.config.StorageHosts[selectedHostIndex]
+// spawn 启动后台任务, 任务需在 p.done 关闭后退出, Shutdown 等待其完成
+func (p *StorageProxy) spawn(fn func()) {
+	p.background.Add(1)
+	go func() {
+		defer p.background.Done()
+		fn()
+	}()
+}
 
-		if strings.HasPrefix(file, "/") {
-			file = strings.Replace(file, "/", "", 1)
-		}
+// waitBackground 等待后台任务退出, ctx 超时后返回错误
+func (p *StorageProxy) waitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-		if p.config.LocalPlot {
-			host = p.config.LocalHost
-		}
+// Reload 重新加载配置文件
+func (p *StorageProxy) Reload() error {
+	return p.reloadConfig(p.reload.ConfigFile, true)
+}
 
-		plotUrl := fmt.Sprintf("http://%v:%v%v/%v", p.config.LocalHost, p.config.FileServerPort, task.PlotFilePrefix, file)
-		finishUrl := fmt.Sprintf("http://%v:%v%v", p.config.LocalHost, p.config.Port, types.FinishPlotAPI)
-		failUrl := fmt.Sprintf("http://%v:%v%v", p.config.LocalHost, p.config.Port, types.FailPlotAPI)
+// Shutdown 停止接受新的任务, 等待正在执行的任务、传输及后台任务完成后关闭监听和数据库
+// 超时未完成的任务保留在数据库中, 重启后继续执行, 之后退出的任务访问数据库返回 db.ErrClosed
+func (p *StorageProxy) Shutdown() error {
+	timeout := time.Duration(p.snapshot().ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-		log.Infof(log.Fields{}, "try to serve file %v -> %v", plotUrl, host)
-		_, err = api.UploadPlot(host, "18080", apitypes.UploadPlotInput{
-			PlotURL:   plotUrl,
-			FinishURL: finishUrl,
-			FailURL:   failUrl,
-		})
-		if err != nil {
-			log.Errorf(log.Fields{}, "fail to notify new plot -> %v", host)
-			continue
-		}
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
 
-		break
+	var errs []string
+	if err := task.Stop(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("task queue: %v", err))
+	}
+	if err := p.apiListener.shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("api server: %v", err))
+	}
+	if err := p.fileListener.shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("plot file server: %v", err))
+	}
+	// 索引, 清理, 备份等仍在访问数据库
+	if err := p.waitBackground(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("background tasks: %v", err))
+	}
+	if err := task.CloseStore(); err != nil {
+		errs = append(errs, fmt.Sprintf("task store: %v", err))
+	}
+	if err := db.Close(); err != nil {
+		errs = append(errs, fmt.Sprintf("database: %v", err))
 	}
 
-	return err
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 func (p *StorageProxy) indexPath(_path string) error {
+	cfg := p.snapshot()
 	keys := []string{}
 
 	err := filepath.Walk(_path, func(path string, info os.FileInfo, err error) error {
@@ -235,22 +292,22 @@ func (p *StorageProxy) indexPath(_path string) error {
 	}
 
 	for _, key := range keys {
-		scannableAt, ok := p.scannableAt[key]
-		if ok {
-			if uint32(time.Now().Unix()) < scannableAt {
-				continue
-			}
+		if !p.quarantine.scannable(key) {
+			continue
 		}
 		if err := p.indexKey(key); err != nil {
-			p.scannableAt[key] = uint32(time.Now().Unix()) + 3600
+			p.quarantine.fail(key, err, cfg.IndexBackoffBase, cfg.IndexBackoffMax)
 			log.Errorf(log.Fields{}, "fail to index %v/%v: %v", _path, key, err)
+			continue
 		}
+		p.quarantine.succeed(key)
 	}
 
 	return nil
 }
 
 func (p *StorageProxy) indexKey(_path string) error {
+	cfg := p.snapshot()
 	const progressFile = "progress.json"
 
 	type progress struct {
@@ -303,7 +360,7 @@ func (p *StorageProxy) indexKey(_path string) error {
 	keys := _m.NumUnits * 2
 	keysDone := 0
 
-	if !p.config.LocalPlot {
+	if !cfg.LocalPlot {
 		err = filepath.Walk(_path, func(path string, info os.FileInfo, err error) error {
 			if !strings.HasSuffix(path, ".bin") && !strings.HasSuffix(path, ".json") {
 				return nil
@@ -321,31 +378,14 @@ func (p *StorageProxy) indexKey(_path string) error {
 				return nil
 			}
 
-			file := path
-			if strings.HasPrefix(path, "/") {
-				file = strings.Replace(path, "/", "", 1)
-			}
-			plotUrl := fmt.Sprintf("http://%v:%v%v/%v", p.config.LocalHost, p.config.FileServerPort, task.PlotFilePrefix, file)
-
-			bdb, err := db.BoltClient()
-			if err != nil {
+			meta, err := task.Store().Get(path)
+			if err == task.ErrTaskNotFound {
 				return nil
 			}
-			if err := bdb.View(func(tx *bolt.Tx) error {
-				bk := tx.Bucket(db.DefaultBucket)
-				r := bk.Get([]byte(plotUrl))
-				if r == nil {
-					return nil
-				}
-				meta := task.Meta{}
-				if err := json.Unmarshal(r, &meta); err != nil {
-					return err
-				}
-				host = meta.Host
-				return nil
-			}); err != nil {
+			if err != nil {
 				return err
 			}
+			host = meta.Host
 			return nil
 		})
 		if err != nil {
@@ -354,7 +394,7 @@ func (p *StorageProxy) indexKey(_path string) error {
 		}
 	}
 
-	plotUrls := []string{}
+	paths := []string{}
 
 	err = filepath.Walk(_path, func(path string, info os.FileInfo, err error) error {
 		if !strings.HasSuffix(path, ".bin") && !strings.HasSuffix(path, ".json") {
@@ -377,56 +417,34 @@ func (p *StorageProxy) indexKey(_path string) error {
 			return nil
 		}
 
-		file := path
-		if strings.HasPrefix(path, "/") {
-			file = strings.Replace(path, "/", "", 1)
-		}
-
 		if host == "" {
-			p.mutex.Lock()
-			selectedHostIndex := p.curHostIndex
-			p.curHostIndex = (p.curHostIndex + 1) % len(p.config.StorageHosts)
-			p.mutex.Unlock()
-			host = p.config.StorageHosts[selectedHostIndex]
-
-			if p.config.LocalPlot {
-				host = p.config.LocalHost
-			}
+			host = p.nextHost(cfg)
 		}
 
-		plotUrl := fmt.Sprintf("http://%v:%v%v/%v", p.config.LocalHost, p.config.FileServerPort, task.PlotFilePrefix, file)
-		finishUrl := fmt.Sprintf("http://%v:%v%v", p.config.LocalHost, p.config.Port, types.FinishPlotAPI)
-		failUrl := fmt.Sprintf("http://%v:%v%v", p.config.LocalHost, p.config.Port, types.FailPlotAPI)
-		plotUrls = append(plotUrls, plotUrl)
+		plotUrl := task.PlotURL(path)
+		paths = append(paths, path)
 
 		// 入库
 		// 更新数据库的数据的状态
-		bdb, err := db.BoltClient()
-		if err != nil {
-			log.Infof(log.Fields{}, "get bolt db client error %v", path)
-			return nil
-		}
-		if err := bdb.Update(func(tx *bolt.Tx) error {
-			bk := tx.Bucket(db.DefaultBucket)
+		old, err := task.Store().Get(path)
+		if err == nil {
 			if !strings.HasSuffix(path, ".json") {
-				if r := bk.Get([]byte(plotUrl)); r != nil {
-					return fmt.Errorf("spacemesh plot file url: %s already added", plotUrl)
-				}
-			}
-			meta := task.Meta{
-				Status:    task.TaskTodo,
-				Host:      host,
-				PlotURL:   plotUrl,
-				FinishURL: finishUrl,
-				FailURL:   failUrl,
-				DiskSpace: diskSpace,
-			}
-			ms, err := json.Marshal(meta)
-			if err != nil {
-				return err
+				return nil
 			}
-			return bk.Put([]byte(plotUrl), ms)
-		}); err != nil {
+			refreshMeta(old, info, diskSpace)
+			return nil
+		}
+		if err := task.Store().Add(task.Meta{
+			Path:      path,
+			Status:    task.TaskTodo,
+			Host:      host,
+			PlotURL:   plotUrl,
+			FinishURL: task.FinishURL(),
+			FailURL:   task.FailURL(),
+			DiskSpace: diskSpace,
+			Size:      uint64(info.Size()),
+			CreatedAt: time.Now().Unix(),
+		}); err != nil && err != task.ErrTaskExists {
 			log.Errorf(log.Fields{}, "%v fail to bolt database %v", plotUrl, err)
 			return nil
 		}
@@ -443,65 +461,74 @@ func (p *StorageProxy) indexKey(_path string) error {
 
 	log.Infof(log.Fields{}, "path %v plot completed, check its status", _path)
 	keyDone := true
-	bdb, err := db.BoltClient()
-	if err != nil {
-		return err
-	}
-	for _, plotUrl := range plotUrls {
-		if err := bdb.View(func(tx *bolt.Tx) error {
-			bk := tx.Bucket(db.DefaultBucket)
-			r := bk.Get([]byte(plotUrl))
-			if r == nil {
-				return fmt.Errorf("invalid ploturl %v", plotUrl)
-			}
-			meta := task.Meta{}
-			if err := json.Unmarshal(r, &meta); err != nil {
-				return err
-			}
-			if strings.HasSuffix(plotUrl, ".json") || strings.HasSuffix(plotUrl, "key.bin") || strings.HasSuffix(plotUrl, "post.bin") {
-				return nil
-			}
-			if meta.Status != task.TaskDone {
-				log.Infof(log.Fields{}, "%v plot completed but still fetching %v", _path, plotUrl)
-				keyDone = false
-				return nil
-			}
-			keysDone += 1
-			return nil
-		}); err != nil {
-			return err
+	for _, path := range paths {
+		meta, err := task.Store().Get(path)
+		if err != nil {
+			return fmt.Errorf("invalid plot file %v: %v", path, err)
+		}
+		if strings.HasSuffix(path, ".json") || strings.HasSuffix(path, "key.bin") || strings.HasSuffix(path, "post.bin") {
+			continue
+		}
+		if meta.Status != task.TaskDone {
+			log.Infof(log.Fields{}, "%v plot completed but still fetching %v", _path, path)
+			keyDone = false
+			continue
 		}
+		keysDone += 1
 	}
 	if !keyDone && keysDone < keys {
 		return nil
 	}
 
+	// 清理前记录去向, 失败时保留目录, 下次索引时重试
+	if err := p.recordPlacement(types.Placement{
+		NodeID:          _m.NodeID,
+		CommitmentAtxID: _m.CommitmentAtxId,
+		NumUnits:        _m.NumUnits,
+		LocalPath:       _path,
+	}, paths); err != nil {
+		return fmt.Errorf("fail to record placement: %v", err)
+	}
+
 	log.Infof(log.Fields{}, "path %v transfer done, try to remove it", _path)
 	os.RemoveAll(_path)
-	for _, plotUrl := range plotUrls {
-		if err := bdb.Update(func(tx *bolt.Tx) error {
-			bk := tx.Bucket(db.DefaultBucket)
-			if err := bk.Delete([]byte(plotUrl)); err != nil {
-				return err
-			}
-			return nil
-		}); err != nil {
+	// 保留到归档中, 可以追溯目录中的文件传输到了哪里
+	for _, path := range paths {
+		if err := task.Archive(path); err != nil {
 			return err
 		}
 	}
+	event.Publish(event.Event{
+		Type:    event.DirCleaned,
+		Dir:     _path,
+		Message: fmt.Sprintf("node %v, %v files", _m.NodeID, len(paths)),
+	})
 
 	return nil
 }
 
-func (p *StorageProxy) indexer() {
-	ticker := time.NewTicker(1 * time.Minute)
-	for range ticker.C {
-		for _, _path := range p.config.PlotPaths {
-			if err := p.indexPath(_path); err != nil {
-				log.Errorf(log.Fields{}, "fail to index %v: %v", _path, err)
-			}
+// refreshMeta plot 期间元数据文件会被改写, 只刷新可变字段, 保留租约、重试及进度
+// 已传输的旧版本重新排队, 排队或传输中的任务不打断
+func refreshMeta(old task.Meta, info os.FileInfo, diskSpace uint64) {
+	size := uint64(info.Size())
+	changed := old.Size != size || info.ModTime().Unix() > old.UpdatedAt
+	if old.Size != size || old.DiskSpace != diskSpace {
+		if _, err := task.Store().Update(old.Path, func(meta *task.Meta) error {
+			meta.Size = size
+			meta.DiskSpace = diskSpace
+			return nil
+		}); err != nil {
+			log.Errorf(log.Fields{}, "fail to refresh %v: %v", old.Path, err)
+			return
 		}
 	}
+	if !changed || (old.Status != task.TaskDone && old.Status != task.TaskErr) {
+		return
+	}
+	_, err := task.Transition(old.Path, task.Trigger{Actor: task.ActorIndexer}, task.TaskTodo, task.TaskDone, task.TaskErr)
+	if err != nil && !errors.Is(err, task.ErrStatusConflict) {
+		log.Errorf(log.Fields{}, "fail to requeue changed %v: %v", old.Path, err)
+	}
 }
 
 func (p *StorageProxy) NewPlotRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
@@ -524,7 +551,13 @@ func (p *StorageProxy) NewPlotRequest(w http.ResponseWriter, req *http.Request)
 		return nil, err.Error(), -3
 	}
 
-	processed := false
+	cfg := p.snapshot()
+	if disk, ok := p.disks.owner(cfg.PlotPaths, input.PlotDir); ok && !disk.Accepting {
+		log.Errorf(log.Fields{}, "plot path %v paused, reject new plot %v: %v", disk.Path, input.PlotDir, disk.Error)
+		return nil, fmt.Sprintf("plot path %v paused, free %.2f%%", disk.Path, disk.FreePercent), -6
+	}
+
+	files := []task.JobFile{}
 	err = filepath.Walk(input.PlotDir, func(path string, info os.FileInfo, err error) error {
 		if !strings.HasSuffix(path, ".plot") {
 			return nil
@@ -542,73 +575,38 @@ func (p *StorageProxy) NewPlotRequest(w http.ResponseWriter, req *http.Request)
 		if info.Size() == 0 {
 			return nil
 		}
-		processed = true
 
-		var (
-			file, host string
-		)
-		p.mutex.Lock()
-		selectedHostIndex := p.curHostIndex
-		p.curHostIndex = (p.curHostIndex + 1) % len(p.config.StorageHosts)
-		p.mutex.Unlock()
-		host = p.config.StorageHosts[selectedHostIndex]
-
-		if strings.HasPrefix(path, "/") {
-			file = strings.Replace(path, "/", "", 1)
-		}
-
-		if p.config.LocalPlot {
-			host = p.config.LocalHost
-		}
-
-		plotUrl := fmt.Sprintf("http://%v:%v%v/%v", p.config.LocalHost, p.config.FileServerPort, task.PlotFilePrefix, file)
-		finishUrl := fmt.Sprintf("http://%v:%v%v", p.config.LocalHost, p.config.Port, types.FinishPlotAPI)
-		failUrl := fmt.Sprintf("http://%v:%v%v", p.config.LocalHost, p.config.Port, types.FailPlotAPI)
+		host := p.nextHost(cfg)
+		plotUrl := task.PlotURL(path)
 
 		// 入库
 		// 更新数据库的数据的状态
-		bdb, err := db.BoltClient()
-		if err != nil {
-			log.Infof(log.Fields{}, "get bolt db client error %v", path)
-			return nil
+		meta := task.Meta{
+			Path:      path,
+			Status:    task.TaskTodo,
+			Host:      host,
+			PlotURL:   plotUrl,
+			FinishURL: task.FinishURL(),
+			FailURL:   task.FailURL(),
+			Size:      uint64(info.Size()),
+			CreatedAt: time.Now().Unix(),
 		}
-		if err := bdb.Update(func(tx *bolt.Tx) error {
-			bk := tx.Bucket(db.DefaultBucket)
-			if r := bk.Get([]byte(plotUrl)); r != nil {
-				return fmt.Errorf("spacemesh plot file url: %s already added", plotUrl)
-			}
-			meta := task.Meta{
-				Status:    task.TaskTodo,
-				Host:      host,
-				PlotURL:   plotUrl,
-				FinishURL: finishUrl,
-				FailURL:   failUrl,
-			}
-			ms, err := json.Marshal(meta)
-			if err != nil {
-				return err
-			}
-			return bk.Put([]byte(plotUrl), ms)
-		}); err != nil {
+		err = task.Store().Add(meta)
+		if err == task.ErrTaskExists {
+			// 重复提交时沿用已有任务, 新的 job 跟踪其当前状态
+			meta, err = task.Store().Get(path)
+		}
+		if err != nil {
 			log.Errorf(log.Fields{}, "%v fail to bolt database %v", plotUrl, err)
 			return nil
 		}
 
-		for {
-			_, err := os.Stat(path)
-			if err == nil {
-				log.Infof(log.Fields{}, "Waiting for %v finish", path)
-				time.Sleep(10 * time.Second)
-				continue
-			}
-			if os.IsNotExist(err) {
-				log.Infof(log.Fields{}, "%v finished", path)
-				break
-			}
-			log.Errorf(log.Fields{}, "CANNOT determine %v's stat", path)
-			break
-		}
-
+		// 等待文件传输完成由任务队列处理
+		files = append(files, task.JobFile{
+			Path:    path,
+			PlotURL: meta.PlotURL,
+			Status:  meta.Status,
+		})
 		return nil
 	})
 	if err != nil {
@@ -616,12 +614,35 @@ func (p *StorageProxy) NewPlotRequest(w http.ResponseWriter, req *http.Request)
 		return nil, err.Error(), -4
 	}
 
-	if !processed {
+	if len(files) == 0 {
 		log.Errorf(log.Fields{}, "cannot find suitable plot file in %v", input.PlotDir)
 		return nil, "cannot find suitable plot file", -5
 	}
 
-	return nil, "", 0
+	job, err := task.NewJob(input.PlotDir, files, input.NotifyURL)
+	if err != nil {
+		log.Errorf(log.Fields{}, "fail to create job of %v: %v", input.PlotDir, err)
+		return nil, err.Error(), -7
+	}
+	log.Infof(log.Fields{}, "job %v created for %v with %v files", job.ID, input.PlotDir, len(files))
+
+	return types.NewPlotOutput{
+		JobID: job.ID,
+	}, "", 0
+}
+
+func (p *StorageProxy) PlotJobRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	id := req.Form.Get("id")
+	if id == "" {
+		return nil, "id is required", -1
+	}
+
+	job, err := task.GetJob(id)
+	if err != nil {
+		return nil, err.Error(), -2
+	}
+
+	return job, "", 0
 }
 
 func (p *StorageProxy) FinishPlotRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
@@ -639,30 +660,25 @@ func (p *StorageProxy) FinishPlotRequest(w http.ResponseWriter, req *http.Reques
 	}
 
 	log.Infof(log.Fields{}, "plot req %v from %v finish", input.PlotFile, req.Host)
+	path := task.PathFromURL(input.PlotFile)
+	if path == "" {
+		return nil, fmt.Sprintf("invalid plot file %v", input.PlotFile), -2
+	}
 
 	// 更新数据库的数据的状态
-	bdb, err := db.BoltClient()
-	if err != nil {
-		return nil, err.Error(), -3
+	// 存储节点可能在 Upload 更新状态之前完成
+	by := task.Trigger{Actor: task.ActorStorage, Remote: req.RemoteAddr}
+	if _, err := task.Transition(path, by, task.TaskFinish, task.TaskTodo, task.TaskWait); err != nil {
+		return nil, err.Error(), -4
 	}
-	if err := bdb.Update(func(tx *bolt.Tx) error {
-		bk := tx.Bucket(db.DefaultBucket)
-		r := bk.Get([]byte(input.PlotFile))
-		if r == nil {
-			return fmt.Errorf("spacemesh plot file %v not found", input.PlotFile)
-		}
-		meta := task.Meta{}
-		if err := json.Unmarshal(r, &meta); err != nil {
-			return err
-		}
-		meta.Status = task.TaskFinish
-		ms, err := json.Marshal(meta)
-		if err != nil {
-			return err
+	if input.RemotePath != "" || input.Checksum != "" {
+		if _, err := task.Store().Update(path, func(meta *task.Meta) error {
+			meta.RemotePath = input.RemotePath
+			meta.Checksum = input.Checksum
+			return nil
+		}); err != nil {
+			log.Errorf(log.Fields{}, "fail to record remote path of %v: %v", path, err)
 		}
-		return bk.Put([]byte(input.PlotFile), ms)
-	}); err != nil {
-		return nil, err.Error(), -4
 	}
 
 	return nil, "", 0
@@ -692,55 +708,201 @@ func (p *StorageProxy) FailPlotRequest(w http.ResponseWriter, req *http.Request)
 	// failUrl := fmt.Sprintf("http://%v:%v%v", p.config.LocalHost, p.config.Port, types.FailPlotAPI)
 
 	log.Infof(log.Fields{}, "plot req %v from %v fail", input.PlotFile, req.Host)
+	path := task.PathFromURL(input.PlotFile)
+	if path == "" {
+		return nil, fmt.Sprintf("invalid plot file %v", input.PlotFile), -3
+	}
 
 	// 更新数据库的数据的状态
-	bdb, err := db.BoltClient()
+	// 按重试策略重新传输, 已经完成的任务不受迟到的失败回调影响
+	by := task.Trigger{Actor: task.ActorStorage, Remote: req.RemoteAddr, Error: "storage server reported failure"}
+	if err := task.Retry(path, by); err != nil {
+		return nil, err.Error(), -5
+	}
+
+	return nil, "", 0
+}
+
+func (p *StorageProxy) ListQuarantineRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	return types.ListQuarantineOutput{
+		Dirs: p.quarantine.list(),
+	}, "", 0
+}
+
+func (p *StorageProxy) ClearQuarantineRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	b, err := ioutil.ReadAll(req.Body)
 	if err != nil {
+		return nil, err.Error(), -1
+	}
+
+	input := types.ClearQuarantineInput{}
+	if err := json.Unmarshal(b, &input); err != nil {
+		return nil, err.Error(), -2
+	}
+	// 空的 dirs 不视为清除全部, 避免误操作
+	if input.All {
+		input.Dirs = nil
+	} else if len(input.Dirs) == 0 {
+		return nil, "dirs is empty, set all to clear every directory", -4
+	}
+
+	log.Infof(log.Fields{}, "clear quarantine %v (all %v) from %v", input.Dirs, input.All, req.Host)
+	if err := p.quarantine.clear(input.Dirs); err != nil {
+		return nil, err.Error(), -3
+	}
+
+	return nil, "", 0
+}
+
+func (p *StorageProxy) SetPriorityRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err.Error(), -1
+	}
+
+	input := types.SetPriorityInput{}
+	if err := json.Unmarshal(b, &input); err != nil {
+		return nil, err.Error(), -2
+	}
+	if input.Dir == "" {
+		return nil, "dir is required", -3
+	}
+
+	log.Infof(log.Fields{}, "set priority of %v to %v from %v", input.Dir, input.Priority, req.Host)
+	if err := task.SetPriority(input.Dir, input.Priority); err != nil {
 		return nil, err.Error(), -4
 	}
-	if err := bdb.Update(func(tx *bolt.Tx) error {
-		bk := tx.Bucket(db.DefaultBucket)
-		/*
-			r := bk.Get([]byte(input.PlotFile))
-			if r == nil {
-				return fmt.Errorf("spacemesh plot file %v not find", input.PlotFile)
-			}
-		*/
 
-		// 删除原有的
-		if err := bk.Delete([]byte(input.PlotFile)); err != nil {
-			return err
-		}
+	return nil, "", 0
+}
 
-		/*
-			meta := task.Meta{}
-			if err := json.Unmarshal(r, &meta); err != nil {
-				return err
-			}
+// CancelTaskRequest 取消任务, 正在进行的请求被中断, 任务标记为 error
+func (p *StorageProxy) CancelTaskRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err.Error(), -1
+	}
 
-			log.Infof(log.Fields{}, "redo %v to %v", plotUrl, meta.Host)
+	input := types.CancelTaskInput{}
+	if err := json.Unmarshal(b, &input); err != nil {
+		return nil, err.Error(), -2
+	}
+	if input.Path == "" {
+		return nil, "path is required", -3
+	}
 
-			// 重新选择别的存储节点
-			meta = task.Meta{
-				Status:    task.TaskTodo,
-				Host:      meta.Host,
-				PlotURL:   plotUrl,
-				FailURL:   failUrl,
-				FinishURL: finishUrl,
-			}
-			ms, err := json.Marshal(meta)
-			if err != nil {
-				return err
-			}
-			go func() {
-				<-time.After(time.Minute)
-				bk.Put([]byte(plotUrl), ms)
-			}()
-		*/
-		return nil
-	}); err != nil {
-		return nil, err.Error(), -5
+	log.Infof(log.Fields{}, "cancel task %v from %v", input.Path, req.Host)
+	if err := task.Cancel(input.Path, req.RemoteAddr); err != nil {
+		return nil, err.Error(), -4
+	}
+
+	return nil, "", 0
+}
+
+// RequeueTaskRequest 将失败的任务改回 todo 重新传输
+func (p *StorageProxy) RequeueTaskRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err.Error(), -1
+	}
+
+	input := types.RequeueTaskInput{}
+	if err := json.Unmarshal(b, &input); err != nil {
+		return nil, err.Error(), -2
+	}
+	if input.Path == "" {
+		return nil, "path is required", -3
+	}
+
+	log.Infof(log.Fields{}, "requeue task %v from %v", input.Path, req.Host)
+	if err := task.Requeue(input.Path, req.RemoteAddr); err != nil {
+		return nil, err.Error(), -4
 	}
 
 	return nil, "", 0
 }
+
+func (p *StorageProxy) ListPriorityRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	priorities, err := task.Priorities()
+	if err != nil {
+		return nil, err.Error(), -1
+	}
+
+	output := types.ListPriorityOutput{
+		Dirs: []types.SetPriorityInput{},
+	}
+	for dir, priority := range priorities {
+		output.Dirs = append(output.Dirs, types.SetPriorityInput{
+			Dir:      dir,
+			Priority: priority,
+		})
+	}
+	sort.Slice(output.Dirs, func(i, j int) bool {
+		return output.Dirs[i].Priority > output.Dirs[j].Priority
+	})
+
+	return output, "", 0
+}
+
+func (p *StorageProxy) ListHostRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	hosts, err := task.Hosts()
+	if err != nil {
+		return nil, err.Error(), -1
+	}
+	return hosts, "", 0
+}
+
+// ListProgressRequest 按目录返回未完成的文件的传输进度及剩余时间
+func (p *StorageProxy) ListProgressRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	dirs, err := task.Progress(req.Form.Get("dir"))
+	if err != nil {
+		return nil, err.Error(), -1
+	}
+	return types.ListProgressOutput{Dirs: dirs}, "", 0
+}
+
+// ListTaskRequest 按 status, host 或 dir 查询任务, 多个条件时取交集
+func (p *StorageProxy) ListTaskRequest(w http.ResponseWriter, req *http.Request) (interface{}, string, int) {
+	status := []uint8{}
+	statusSet := map[uint8]bool{}
+	if names := req.Form.Get("status"); names != "" {
+		for _, name := range strings.Split(names, ",") {
+			s, ok := task.ParseStatus(strings.TrimSpace(name))
+			if !ok {
+				return nil, fmt.Sprintf("invalid status %v", name), -1
+			}
+			status = append(status, s)
+			statusSet[s] = true
+		}
+	}
+	host := req.Form.Get("host")
+	dir := req.Form.Get("dir")
+
+	var metas []task.Meta
+	var err error
+	switch {
+	case dir != "":
+		metas, err = task.Store().ListByDir(filepath.Clean(dir))
+	case host != "":
+		metas, err = task.Store().ListByHost(host)
+	case len(status) > 0:
+		metas, err = task.Store().ListByStatus(status...)
+	default:
+		return nil, "status, host or dir is required", -2
+	}
+	if err != nil {
+		return nil, err.Error(), -3
+	}
+
+	output := []task.Meta{}
+	for _, meta := range metas {
+		if host != "" && meta.Host != host {
+			continue
+		}
+		if len(status) > 0 && !statusSet[meta.Status] {
+			continue
+		}
+		output = append(output, meta)
+	}
+	return output, "", 0
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+)
+
+const (
+	// 每个连接等待发送的事件数, 客户端太慢时丢弃
+	streamBufferSize = 256
+	streamKeepAlive  = 15 * time.Second
+)
+
+var (
+	streamClients = metrics.NewGauge("spacemesh_proxy_event_stream_clients", "Connected event stream clients")
+	streamDropped = metrics.NewCounter("spacemesh_proxy_event_stream_dropped_total", "Events dropped for slow stream clients")
+)
+
+// streamFilter 为空的条件不过滤, type 以逗号分隔, 为空时包含所有事件 (包括进度)
+type streamFilter struct {
+	host  string
+	dir   string
+	path  string
+	types []string
+}
+
+func (f streamFilter) match(ev event.Event) bool {
+	if f.host != "" && ev.Host != f.host {
+		return false
+	}
+	if f.dir != "" && ev.Dir != f.dir {
+		return false
+	}
+	if f.path != "" && ev.Path != f.path {
+		return false
+	}
+	if len(f.types) > 0 && !event.Match(f.types, ev.Type) {
+		return false
+	}
+	return true
+}
+
+// StreamHandler 以 Server-Sent Events 推送实时事件, 可按 host, dir, path 及 type 过滤
+// 已记录的事件以事件记录的序号为 id, 重连时带 Last-Event-ID 先补发之后记录的事件 (进度除外)
+// 服务停止时结束, 客户端需要自行重连
+func (p *StorageProxy) StreamHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := req.URL.Query()
+	filter := streamFilter{
+		host: query.Get("host"),
+		path: query.Get("path"),
+	}
+	if dir := query.Get("dir"); dir != "" {
+		filter.dir = filepath.Clean(dir)
+	}
+	for _, typ := range strings.Split(query.Get("type"), ",") {
+		if typ = strings.TrimSpace(typ); typ == "" {
+			continue
+		}
+		if !event.Valid(typ) {
+			http.Error(w, fmt.Sprintf("unknown event %v, available %v", typ, event.Types()), http.StatusBadRequest)
+			return
+		}
+		filter.types = append(filter.types, typ)
+	}
+	var last uint64
+	if id := req.Header.Get("Last-Event-ID"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID %v: %v", id, err), http.StatusBadRequest)
+			return
+		}
+		last = n
+	}
+
+	events := make(chan event.Event, streamBufferSize)
+	unsubscribe := event.Subscribe(func(ev event.Event) {
+		if !filter.match(ev) {
+			return
+		}
+		select {
+		case events <- ev:
+		default:
+			streamDropped.Inc()
+		}
+	})
+	defer unsubscribe()
+
+	streamClients.Add(1)
+	defer streamClients.Add(-1)
+	log.Infof(log.Fields{}, "event stream from %v: %v", req.RemoteAddr, req.URL.RawQuery)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// 先订阅再补发, 补发期间的实时事件在 events 中等待, 已补发的按序号跳过
+	if last > 0 {
+		var err error
+		if last, err = replayEvents(w, filter, last); err != nil {
+			log.Errorf(log.Fields{}, "fail to replay events to %v: %v", req.RemoteAddr, err)
+			return
+		}
+		flusher.Flush()
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if ev.Seq != 0 && ev.Seq <= last {
+				continue
+			}
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		case <-p.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// replayEvents 补发序号大于 after 的符合条件的事件, 返回最后补发或跳过的序号
+func replayEvents(w http.ResponseWriter, filter streamFilter, after uint64) (uint64, error) {
+	for {
+		records, err := listEvents(EventFilter{
+			Path:  filter.path,
+			Dir:   filter.dir,
+			After: after,
+			Limit: MaxEventLimit,
+		})
+		if err != nil {
+			return after, err
+		}
+		for _, record := range records {
+			after = record.Seq
+			if !filter.match(record.Event) {
+				continue
+			}
+			if err := writeEvent(w, record.Event); err != nil {
+				return after, err
+			}
+		}
+		if len(records) < MaxEventLimit {
+			return after, nil
+		}
+	}
+}
+
+// writeEvent 已记录的事件以序号为 id, 未记录的不带 id, 不改变客户端的 Last-Event-ID
+func writeEvent(w http.ResponseWriter, ev event.Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		log.Errorf(log.Fields{}, "fail to marshal event %v: %v", ev.ID, err)
+		return nil
+	}
+	if ev.Seq != 0 {
+		if _, err := fmt.Fprintf(w, "id: %v\n", ev.Seq); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %v\ndata: %s\n\n", ev.Type, b)
+	return err
+}
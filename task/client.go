@@ -0,0 +1,124 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	httpdaemon "github.com/NpoolRD/http-daemon"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+	apitypes "github.com/NpoolSpacemesh/spacemesh-storage-server/types"
+)
+
+const DefaultRequestTimeout = 30
+
+// 任务失败的原因
+const (
+	FailTimeout   = "timeout"
+	FailCancelled = "cancelled"
+	FailRequest   = "request"
+	FailStalled   = "stalled"
+	FailStorage   = "storage"
+	FailPanic     = "panic"
+)
+
+var taskFailures = metrics.NewCounter("spacemesh_proxy_task_failures_total", "Task handler failures by reason", "reason")
+
+var requestTimeout = struct {
+	timeout time.Duration
+	lock    sync.RWMutex
+}{timeout: DefaultRequestTimeout * time.Second}
+
+// SetRequestTimeout 设置访问存储节点等外部服务的超时, 单位秒
+func SetRequestTimeout(seconds int) {
+	if seconds <= 0 {
+		seconds = DefaultRequestTimeout
+	}
+	requestTimeout.lock.Lock()
+	requestTimeout.timeout = time.Duration(seconds) * time.Second
+	requestTimeout.lock.Unlock()
+}
+
+// RequestContext 返回带超时的 context, 所有对外的请求都需要使用
+func RequestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	requestTimeout.lock.RLock()
+	timeout := requestTimeout.timeout
+	requestTimeout.lock.RUnlock()
+	return context.WithTimeout(ctx, timeout)
+}
+
+// FailReason 区分超时, 取消及其他请求错误
+func FailReason(err error) string {
+	var nerr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return FailTimeout
+	case errors.Is(err, context.Canceled):
+		return FailCancelled
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return FailTimeout
+	}
+	return FailRequest
+}
+
+// uploadPlot 同 api.UploadPlot, 可以超时及取消
+func uploadPlot(ctx context.Context, host, port string, input apitypes.UploadPlotInput) (*apitypes.UploadPlotOutput, error) {
+	ctx, cancel := RequestContext(ctx)
+	defer cancel()
+
+	addr := net.JoinHostPort(host, port)
+	resp, err := httpdaemon.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(input).
+		Post(fmt.Sprintf("http://%v%v", addr, apitypes.UploadPlotAPI))
+	if err != nil {
+		// resty 返回的错误不一定包装了 context 的错误
+		if ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+			return nil, fmt.Errorf("%v: %w", err, ctx.Err())
+		}
+		return nil, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("upload plot to %v: status %v", addr, resp.StatusCode())
+	}
+
+	apiResp, err := httpdaemon.ParseResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	output := apitypes.UploadPlotOutput{}
+	b, _ := json.Marshal(apiResp.Body)
+	err = json.Unmarshal(b, &output)
+	return &output, err
+}
+
+// UploadPlot 通知存储节点拉取文件, 超时由 SetRequestTimeout 设置
+func UploadPlot(ctx context.Context, host string, input apitypes.UploadPlotInput) error {
+	_, err := uploadPlot(ctx, host, "18080", input)
+	return err
+}
+
+// setFailure 在修改任务的事务中记录失败原因
+func setFailure(m *Meta, reason string, cause error) {
+	m.Error = cause.Error()
+	m.FailReason = reason
+	m.FailedAt = time.Now().Unix()
+}
+
+// recordFailure 记录处理失败的原因, 不修改状态
+func recordFailure(path, reason string, cause error) {
+	taskFailures.Inc(reason)
+	if _, err := Store().Update(path, func(m *Meta) error {
+		setFailure(m, reason, cause)
+		return nil
+	}); err != nil && err != ErrTaskNotFound {
+		log.Errorf(log.Fields{}, "fail to record error of %v: %v", path, err)
+	}
+}
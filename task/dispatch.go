@@ -0,0 +1,233 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+)
+
+var (
+	taskUnhandled   = metrics.NewCounter("spacemesh_proxy_task_unhandled_total", "Tasks skipped because no handler is registered for their status", "status")
+	handlerPanics   = metrics.NewCounter("spacemesh_proxy_task_handler_panics_total", "Task handlers that panicked, the task is marked err", "status")
+	subscriberPanic = metrics.NewCounter("spacemesh_proxy_task_subscriber_panics_total", "Transition subscribers that panicked")
+)
+
+// 状态变更的发起者
+const (
+	// 队列中的处理函数
+	ActorQueue = "queue"
+	// 存储节点回调完成或失败
+	ActorStorage = "storage"
+	// 运维通过 API 操作
+	ActorAPI = "api"
+	// 停滞检测
+	ActorWatchdog = "watchdog"
+	// 重试次数用完
+	ActorRetry = "retry"
+	// 处理函数 panic
+	ActorDispatcher = "dispatcher"
+	// 索引时发现文件变化
+	ActorIndexer = "indexer"
+)
+
+// Trigger 谁因为什么发起了状态变更
+type Trigger struct {
+	Actor string `json:"actor"`
+	// 发起请求的地址或通知的存储节点
+	Remote string `json:"remote,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// TransitionEvent 一次已提交的状态变更
+type TransitionEvent struct {
+	// 发布的事件的 ID, 及写入事件记录时的序号
+	ID   string  `json:"id"`
+	Seq  uint64  `json:"seq,omitempty"`
+	Path string  `json:"path"`
+	From uint8   `json:"from"`
+	To   uint8   `json:"to"`
+	By   Trigger `json:"by"`
+	// 变更后的任务
+	Meta Meta  `json:"meta"`
+	At   int64 `json:"at"`
+}
+
+type subscriber struct {
+	to map[uint8]bool
+	fn func(TransitionEvent)
+}
+
+type dispatcher struct {
+	subscribers []subscriber
+	lock        sync.RWMutex
+}
+
+var globalDispatcher = &dispatcher{}
+
+func init() {
+	// 状态变更同时作为事件发布
+	OnTransition(func(ev TransitionEvent) {
+		event.Publish(ev.event())
+	})
+}
+
+func newTransition(meta Meta, prev uint8, by Trigger) TransitionEvent {
+	return TransitionEvent{
+		ID:   event.NewID(),
+		Path: meta.Path,
+		From: prev,
+		To:   meta.Status,
+		By:   by,
+		Meta: meta,
+		At:   meta.UpdatedAt,
+	}
+}
+
+// event 转为发布及记录的事件
+func (ev TransitionEvent) event() event.Event {
+	return event.Event{
+		ID:     ev.ID,
+		Seq:    ev.Seq,
+		Type:   event.TaskTransition,
+		Time:   ev.At,
+		Path:   ev.Path,
+		Dir:    ev.Meta.Dir(),
+		Host:   ev.Meta.Host,
+		From:   StatusName(ev.From),
+		To:     StatusName(ev.To),
+		Actor:  ev.By.Actor,
+		Remote: ev.By.Remote,
+		Error:  ev.By.Error,
+	}
+}
+
+// OnTransition 订阅状态变更, to 为空时订阅所有变更
+// 在变更者的 goroutine 中同步调用, 耗时的处理需要自行异步
+func OnTransition(fn func(TransitionEvent), to ...uint8) {
+	sub := subscriber{fn: fn}
+	if len(to) > 0 {
+		sub.to = map[uint8]bool{}
+		for _, s := range to {
+			sub.to[s] = true
+		}
+	}
+	globalDispatcher.lock.Lock()
+	globalDispatcher.subscribers = append(globalDispatcher.subscribers, sub)
+	globalDispatcher.lock.Unlock()
+}
+
+// Transition 修改任务状态并通知订阅者, by 记录发起者, 其他参数同 TaskStore.Transition
+func Transition(path string, by Trigger, to uint8, from ...uint8) (Meta, error) {
+	return TransitionUpdate(path, by, to, nil, from...)
+}
+
+// TransitionUpdate 同 Transition, fn 在同一个事务中修改任务, 参数同 TaskStore.TransitionUpdate
+func TransitionUpdate(path string, by Trigger, to uint8, fn func(meta *Meta) error, from ...uint8) (Meta, error) {
+	ev, err := Store().TransitionUpdate(path, by, to, fn, from...)
+	if err != nil {
+		return ev.Meta, err
+	}
+	globalDispatcher.publish(ev)
+	return ev.Meta, nil
+}
+
+func (d *dispatcher) publish(ev TransitionEvent) {
+	d.lock.RLock()
+	subs := d.subscribers
+	d.lock.RUnlock()
+
+	for _, sub := range subs {
+		if sub.to != nil && !sub.to[ev.To] {
+			continue
+		}
+		if err := safeCall(func() { sub.fn(ev) }); err != nil {
+			log.Errorf(log.Fields{}, "transition subscriber of %v %v -> %v panic: %v", ev.Path, StatusName(ev.From), StatusName(ev.To), err)
+			subscriberPanic.Inc()
+		}
+	}
+}
+
+// safeCall 将 panic 转为带调用栈的错误
+func safeCall(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v\n%s", r, debug.Stack())
+		}
+	}()
+	fn()
+	return nil
+}
+
+// Handler 处理某个状态的任务, 任务被取消或队列停止时 ctx 被取消
+type Handler func(ctx context.Context, meta Meta)
+
+// dispatch 依次执行状态对应的处理函数, panic 时任务标记为 err 并记录调用栈
+func dispatch(ctx context.Context, meta Meta, handlers []Handler) {
+	if len(handlers) == 0 {
+		log.Errorf(log.Fields{}, "no handler for %v in status %v, skip", meta.Path, StatusName(meta.Status))
+		taskUnhandled.Inc(StatusName(meta.Status))
+		return
+	}
+	for _, handler := range handlers {
+		if ctx.Err() != nil {
+			return
+		}
+		err := safeCall(func() { handler(ctx, meta) })
+		if err == nil {
+			continue
+		}
+		log.Errorf(log.Fields{}, "handler of %v in status %v panic: %v", meta.Path, StatusName(meta.Status), err)
+		handlerPanics.Inc(StatusName(meta.Status))
+		failTask(meta, err)
+		return
+	}
+}
+
+// failTask 处理函数仍未修改状态时标记为 err, 原因与状态在同一个事务中写入
+func failTask(meta Meta, reason error) {
+	taskFailures.Inc(FailPanic)
+	by := Trigger{Actor: ActorDispatcher, Error: reason.Error()}
+	if _, err := TransitionUpdate(meta.Path, by, TaskErr, func(m *Meta) error {
+		if err := checkLease(m); err != nil {
+			return err
+		}
+		setFailure(m, FailPanic, reason)
+		return nil
+	}, meta.Status); err != nil {
+		log.Errorf(log.Fields{}, "fail to mark %v err: %v", meta.Path, err)
+	}
+}
+
+// Cancel 取消任务, 正在执行的处理函数的 ctx 被取消, 未完成的任务标记为 err, remote 为发起请求的地址
+func Cancel(path, remote string) error {
+	running := globalQueue.Cancel(path)
+	by := Trigger{Actor: ActorAPI, Remote: remote, Error: context.Canceled.Error()}
+	if _, err := Transition(path, by, TaskErr, TaskTodo, TaskWait, TaskFinish); err != nil {
+		return err
+	}
+	log.Infof(log.Fields{}, "cancel %v, running %v", path, running)
+	recordFailure(path, FailCancelled, context.Canceled)
+	return nil
+}
+
+// Requeue 将失败的任务改回 todo, 重试次数清零后立即可被拉取, remote 为发起请求的地址
+func Requeue(path, remote string) error {
+	by := Trigger{Actor: ActorAPI, Remote: remote}
+	if _, err := Transition(path, by, TaskTodo, TaskErr); err != nil {
+		return err
+	}
+	if _, err := Store().Update(path, func(meta *Meta) error {
+		meta.Retries = 0
+		meta.NextRetryAt = 0
+		return nil
+	}); err != nil {
+		return err
+	}
+	log.Infof(log.Fields{}, "requeue %v", path)
+	return nil
+}
@@ -0,0 +1,62 @@
+package task
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+)
+
+// endpoint 本机对存储节点提供的地址, 配置变更后生成的 url 随之变更
+type endpoint struct {
+	host     string
+	filePort int
+	apiPort  int
+	lock     sync.RWMutex
+}
+
+var globalEndpoint = &endpoint{}
+
+// SetEndpoint 设置本机地址, 文件服务端口及 API 端口
+func SetEndpoint(host string, filePort, apiPort int) {
+	globalEndpoint.lock.Lock()
+	globalEndpoint.host = host
+	globalEndpoint.filePort = filePort
+	globalEndpoint.apiPort = apiPort
+	globalEndpoint.lock.Unlock()
+}
+
+// PlotURL 本地文件的下载地址
+func PlotURL(path string) string {
+	globalEndpoint.lock.RLock()
+	defer globalEndpoint.lock.RUnlock()
+	return fmt.Sprintf("http://%v:%v%v/%v", globalEndpoint.host, globalEndpoint.filePort, PlotFilePrefix, strings.TrimPrefix(path, "/"))
+}
+
+// FinishURL 存储节点完成后回调的地址
+func FinishURL() string {
+	globalEndpoint.lock.RLock()
+	defer globalEndpoint.lock.RUnlock()
+	return fmt.Sprintf("http://%v:%v%v", globalEndpoint.host, globalEndpoint.apiPort, types.FinishPlotAPI)
+}
+
+// FailURL 存储节点失败后回调的地址
+func FailURL() string {
+	globalEndpoint.lock.RLock()
+	defer globalEndpoint.lock.RUnlock()
+	return fmt.Sprintf("http://%v:%v%v", globalEndpoint.host, globalEndpoint.apiPort, types.FailPlotAPI)
+}
+
+// PathFromURL 从下载地址中取出本地文件路径, 与生成地址时的 host 和端口无关
+func PathFromURL(plotURL string) string {
+	u, err := url.Parse(plotURL)
+	if err != nil {
+		return ""
+	}
+	if !strings.HasPrefix(u.Path, PlotFileHandle) {
+		return ""
+	}
+	return strings.TrimPrefix(u.Path, PlotFilePrefix)
+}
@@ -0,0 +1,256 @@
+package task
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	ExportJSON   = "json"
+	ExportNDJSON = "ndjson"
+)
+
+const (
+	RecordTask      = "task"
+	RecordHistory   = "history"
+	RecordJob       = "job"
+	RecordPlacement = "placement"
+)
+
+// Export json 格式的导出
+type Export struct {
+	// 导出时的数据库版本
+	Version    int       `json:"version"`
+	ExportedAt int64     `json:"exported_at"`
+	Tasks      []Meta    `json:"tasks"`
+	History    []History `json:"history"`
+	Jobs       []Job     `json:"jobs"`
+	// 目录清理后不在任务中, 只能从这里恢复
+	Placements []types.Placement `json:"placements"`
+}
+
+// ExportRecord ndjson 格式的一行
+type ExportRecord struct {
+	Kind      string           `json:"kind"`
+	Task      *Meta            `json:"task,omitempty"`
+	History   *History         `json:"history,omitempty"`
+	Job       *Job             `json:"job,omitempty"`
+	Placement *types.Placement `json:"placement,omitempty"`
+}
+
+// ImportResult 导入的记录数
+type ImportResult struct {
+	Tasks      int `json:"tasks"`
+	History    int `json:"history"`
+	Jobs       int `json:"jobs"`
+	Placements int `json:"placements"`
+	// 已存在而跳过的记录
+	Skipped int `json:"skipped"`
+}
+
+// ExportFormat 按扩展名选择格式, .ndjson 及 .jsonl 为 ndjson, 其余为 json
+func ExportFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".ndjson", ".jsonl":
+		return ExportNDJSON
+	default:
+		return ExportJSON
+	}
+}
+
+func exportAll() (Export, error) {
+	export := Export{
+		Version:    db.SchemaVersion,
+		ExportedAt: time.Now().Unix(),
+	}
+	var err error
+	if export.Tasks, err = Store().ListByStatus(Statuses()...); err != nil {
+		return export, err
+	}
+	if export.History, err = ListHistory(""); err != nil {
+		return export, err
+	}
+	if export.Jobs, err = ListJobs(); err != nil {
+		return export, err
+	}
+	export.Placements, err = ListPlacements("", "")
+	return export, err
+}
+
+// ExportTo 导出所有任务, 归档的任务, 目录任务及目录的去向
+func ExportTo(w io.Writer, format string) error {
+	export, err := exportAll()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(export)
+	case ExportNDJSON:
+		enc := json.NewEncoder(w)
+		for i := range export.Tasks {
+			if err := enc.Encode(ExportRecord{Kind: RecordTask, Task: &export.Tasks[i]}); err != nil {
+				return err
+			}
+		}
+		for i := range export.History {
+			if err := enc.Encode(ExportRecord{Kind: RecordHistory, History: &export.History[i]}); err != nil {
+				return err
+			}
+		}
+		for i := range export.Jobs {
+			if err := enc.Encode(ExportRecord{Kind: RecordJob, Job: &export.Jobs[i]}); err != nil {
+				return err
+			}
+		}
+		for i := range export.Placements {
+			if err := enc.Encode(ExportRecord{Kind: RecordPlacement, Placement: &export.Placements[i]}); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown export format %v", format)
+	}
+}
+
+// ImportFrom 导入 ExportTo 的输出, replace 为 false 时跳过已存在的记录
+func ImportFrom(r io.Reader, format string, replace bool) (ImportResult, error) {
+	result := ImportResult{}
+	im := func(rec ExportRecord) error {
+		ok, err := importRecord(rec, replace)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			result.Skipped++
+			return nil
+		}
+		switch rec.Kind {
+		case RecordTask:
+			result.Tasks++
+		case RecordHistory:
+			result.History++
+		case RecordJob:
+			result.Jobs++
+		case RecordPlacement:
+			result.Placements++
+		}
+		return nil
+	}
+
+	switch format {
+	case ExportJSON:
+		export := Export{}
+		if err := json.NewDecoder(r).Decode(&export); err != nil {
+			return result, err
+		}
+		if export.Version > db.SchemaVersion {
+			return result, fmt.Errorf("export version %v is newer than supported %v", export.Version, db.SchemaVersion)
+		}
+		for i := range export.Tasks {
+			if err := im(ExportRecord{Kind: RecordTask, Task: &export.Tasks[i]}); err != nil {
+				return result, err
+			}
+		}
+		for i := range export.History {
+			if err := im(ExportRecord{Kind: RecordHistory, History: &export.History[i]}); err != nil {
+				return result, err
+			}
+		}
+		for i := range export.Jobs {
+			if err := im(ExportRecord{Kind: RecordJob, Job: &export.Jobs[i]}); err != nil {
+				return result, err
+			}
+		}
+		for i := range export.Placements {
+			if err := im(ExportRecord{Kind: RecordPlacement, Placement: &export.Placements[i]}); err != nil {
+				return result, err
+			}
+		}
+		return result, nil
+	case ExportNDJSON:
+		scanner := bufio.NewScanner(r)
+		// 目录任务包含所有文件, 一行可能较长
+		scanner.Buffer(make([]byte, 64<<10), 64<<20)
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			rec := ExportRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				return result, fmt.Errorf("line %v: %v", line, err)
+			}
+			if err := im(rec); err != nil {
+				return result, fmt.Errorf("line %v: %v", line, err)
+			}
+		}
+		return result, scanner.Err()
+	default:
+		return result, fmt.Errorf("unknown import format %v", format)
+	}
+}
+
+// importRecord 返回是否写入
+func importRecord(rec ExportRecord, replace bool) (bool, error) {
+	switch {
+	case rec.Kind == RecordTask && rec.Task != nil:
+		if rec.Task.Path == "" {
+			return false, fmt.Errorf("task without path")
+		}
+		if replace {
+			return true, Store().Put(*rec.Task)
+		}
+		err := Store().Add(*rec.Task)
+		if err == ErrTaskExists {
+			return false, nil
+		}
+		return err == nil, err
+	case rec.Kind == RecordHistory && rec.History != nil:
+		return putIfAbsent(db.HistoryBucket, historyKey(rec.History.ArchivedAt, rec.History.Path), rec.History, replace)
+	case rec.Kind == RecordJob && rec.Job != nil:
+		if rec.Job.ID == "" {
+			return false, fmt.Errorf("job without id")
+		}
+		return putIfAbsent(db.JobBucket, []byte(rec.Job.ID), rec.Job, replace)
+	case rec.Kind == RecordPlacement && rec.Placement != nil:
+		if rec.Placement.NodeID == "" {
+			return false, fmt.Errorf("placement without node id")
+		}
+		return putIfAbsent(db.PlacementBucket, db.PlacementKey(rec.Placement.NodeID, rec.Placement.LocalPath), rec.Placement, replace)
+	default:
+		return false, fmt.Errorf("invalid record of kind %v", rec.Kind)
+	}
+}
+
+func putIfAbsent(bucket, key []byte, v interface{}, replace bool) (bool, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	put := false
+	err = db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(bucket)
+		if !replace && bk.Get(key) != nil {
+			return nil
+		}
+		put = true
+		return bk.Put(key, b)
+	})
+	return put, err
+}
@@ -0,0 +1,125 @@
+package task
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/boltdb/bolt"
+)
+
+// History 归档的任务
+type History struct {
+	Meta
+	ArchivedAt int64 `json:"archived_at"`
+}
+
+// historyKey 按归档时间排序, 清理时从头遍历
+func historyKey(archivedAt int64, path string) []byte {
+	key := make([]byte, 8, 8+len(path))
+	binary.BigEndian.PutUint64(key, uint64(archivedAt))
+	return append(key, path...)
+}
+
+// ArchiveTasks 将本地文件已不存在, 且超过 after 未变更的已完成或失败的任务移到 db.HistoryBucket
+// 本地文件仍然存在的任务保留, 否则索引时会被重新添加
+func ArchiveTasks(after time.Duration) (int, error) {
+	metas, err := Store().ListByStatus(TaskDone, TaskErr)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	archived := 0
+	for _, meta := range metas {
+		last := meta.UpdatedAt
+		if last == 0 {
+			last = meta.CreatedAt
+		}
+		if now.Sub(time.Unix(last, 0)) < after {
+			continue
+		}
+		if _, err := os.Stat(meta.LocalPath()); !os.IsNotExist(err) {
+			continue
+		}
+
+		if err := archive(meta, now); err != nil {
+			return archived, err
+		}
+		archived++
+	}
+	return archived, nil
+}
+
+// Archive 将任务移到 db.HistoryBucket, 用于目录清理后删除其中的任务, 任务不存在时忽略
+func Archive(path string) error {
+	meta, err := Store().Get(path)
+	if err == ErrTaskNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return archive(meta, time.Now())
+}
+
+func archive(meta Meta, now time.Time) error {
+	b, err := json.Marshal(History{
+		Meta:       meta,
+		ArchivedAt: now.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.HistoryBucket).Put(historyKey(now.Unix(), meta.Path), b)
+	}); err != nil {
+		return err
+	}
+	if err := Store().Delete(meta.Path); err != nil {
+		return err
+	}
+	log.Infof(log.Fields{}, "archive %v task %v", StatusName(meta.Status), meta.Path)
+	return nil
+}
+
+// PurgeHistory 删除归档超过 retention 的任务
+func PurgeHistory(retention time.Duration) (int, error) {
+	limit := historyKey(time.Now().Add(-retention).Unix(), "")
+	purged := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(db.HistoryBucket).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, limit) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// ListHistory 返回归档的任务, path 不为空时只返回该文件的记录
+func ListHistory(path string) ([]History, error) {
+	histories := []History{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.HistoryBucket).ForEach(func(k, v []byte) error {
+			if path != "" && string(k[8:]) != path {
+				return nil
+			}
+			h := History{}
+			if err := json.Unmarshal(v, &h); err != nil {
+				log.Errorf(log.Fields{}, "invalid history %v: %v", string(k[8:]), err)
+				return nil
+			}
+			histories = append(histories, h)
+			return nil
+		})
+	})
+	return histories, err
+}
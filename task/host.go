@@ -0,0 +1,83 @@
+package task
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
+	"github.com/boltdb/bolt"
+)
+
+// Host 存储节点最近一次通知的结果
+type Host struct {
+	Host         string `json:"host"`
+	Uploads      uint64 `json:"uploads"`
+	Failures     uint64 `json:"failures"`
+	LastUploadAt int64  `json:"last_upload_at"`
+	LastFailAt   int64  `json:"last_fail_at"`
+	LastError    string `json:"last_error"`
+}
+
+func recordHost(host string, cause error) {
+	// 只在状态变化时发布事件, 首次失败也视为下线
+	changed := false
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(db.HostBucket)
+		h := Host{Host: host}
+		if r := bk.Get([]byte(host)); r != nil {
+			if err := json.Unmarshal(r, &h); err != nil {
+				return err
+			}
+		}
+		down := h.Failures > 0 && h.LastFailAt >= h.LastUploadAt
+		changed = down != (cause != nil)
+		now := time.Now().Unix()
+		if cause != nil {
+			h.Failures++
+			h.LastFailAt = now
+			h.LastError = cause.Error()
+		} else {
+			h.Uploads++
+			h.LastUploadAt = now
+		}
+		b, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		return bk.Put([]byte(host), b)
+	}); err != nil {
+		log.Errorf(log.Fields{}, "fail to record host %v: %v", host, err)
+		return
+	}
+	if !changed {
+		return
+	}
+	if cause != nil {
+		event.Publish(event.Event{Type: event.HostDown, Host: host, Error: cause.Error()})
+		return
+	}
+	event.Publish(event.Event{Type: event.HostUp, Host: host})
+}
+
+// Hosts 返回所有存储节点
+func Hosts() ([]Host, error) {
+	hosts := []Host{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.HostBucket).ForEach(func(k, v []byte) error {
+			h := Host{}
+			if err := json.Unmarshal(v, &h); err != nil {
+				log.Errorf(log.Fields{}, "invalid host %v: %v", string(k), err)
+				return nil
+			}
+			hosts = append(hosts, h)
+			return nil
+		})
+	})
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Host < hosts[j].Host
+	})
+	return hosts, err
+}
@@ -0,0 +1,277 @@
+package task
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	httpdaemon "github.com/NpoolRD/http-daemon"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+const jobWatchInterval = 10 * time.Second
+
+var ErrJobNotFound = errors.New("job not found")
+
+// JobFile 任务中的一个 plot 文件
+type JobFile struct {
+	Path    string `json:"path"`
+	PlotURL string `json:"plot_url"`
+	Status  uint8  `json:"status"`
+	// 本地文件已被移除
+	Finished bool `json:"finished"`
+}
+
+// Job 一次 NewPlotRequest 注册的目录
+type Job struct {
+	ID     string    `json:"id"`
+	Dir    string    `json:"dir"`
+	Status string    `json:"status"`
+	Error  string    `json:"error"`
+	Files  []JobFile `json:"files"`
+	// 任务结束时通知的地址
+	NotifyURL string `json:"notify_url"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewJob 登记目录下的文件, 返回任务 ID, 文件的传输由队列完成
+func NewJob(dir string, files []JobFile, notifyURL string) (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now().Unix()
+	job := Job{
+		ID:        id,
+		Dir:       dir,
+		Status:    JobRunning,
+		Files:     files,
+		NotifyURL: notifyURL,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	return job, putJob(job)
+}
+
+// GetJob 查询任务状态
+func GetJob(id string) (Job, error) {
+	job := Job{}
+	err := db.View(func(tx *bolt.Tx) error {
+		r := tx.Bucket(db.JobBucket).Get([]byte(id))
+		if r == nil {
+			return ErrJobNotFound
+		}
+		return json.Unmarshal(r, &job)
+	})
+	return job, err
+}
+
+func putJob(job Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.JobBucket).Put([]byte(job.ID), b)
+	})
+}
+
+func runningJobs() ([]Job, error) {
+	return listJobs(func(job Job) bool {
+		return job.Status == JobRunning
+	})
+}
+
+// ListJobs 返回所有目录任务
+func ListJobs() ([]Job, error) {
+	return listJobs(func(job Job) bool {
+		return true
+	})
+}
+
+func listJobs(match func(Job) bool) ([]Job, error) {
+	jobs := []Job{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.JobBucket).ForEach(func(k, v []byte) error {
+			job := Job{}
+			if err := json.Unmarshal(v, &job); err != nil {
+				log.Errorf(log.Fields{}, "invalid job %v: %v", string(k), err)
+				return nil
+			}
+			if match(job) {
+				jobs = append(jobs, job)
+			}
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// PurgeJobs 删除结束超过 retention 的目录任务, 进行中的保留
+func PurgeJobs(retention time.Duration) (int, error) {
+	before := time.Now().Add(-retention).Unix()
+	purged := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(db.JobBucket)
+		ids := [][]byte{}
+		if err := bk.ForEach(func(k, v []byte) error {
+			job := Job{}
+			if err := json.Unmarshal(v, &job); err != nil {
+				log.Errorf(log.Fields{}, "invalid job %v: %v", string(k), err)
+				return nil
+			}
+			if job.Status != JobRunning && job.UpdatedAt < before {
+				ids = append(ids, append([]byte{}, k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		// 遍历期间不能删除
+		for _, id := range ids {
+			if err := bk.Delete(id); err != nil {
+				return err
+			}
+		}
+		purged = len(ids)
+		return nil
+	})
+	return purged, err
+}
+
+// watchJobs 等待任务中的文件传输完成并被移除, ctx 取消后退出
+func watchJobs(ctx context.Context) {
+	ticker := time.NewTicker(jobWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		jobs, err := runningJobs()
+		if err != nil {
+			log.Errorf(log.Fields{}, "fail to load running jobs: %v", err)
+			continue
+		}
+		for _, job := range jobs {
+			if err := watchJob(ctx, job); err != nil {
+				log.Errorf(log.Fields{}, "fail to watch job %v: %v", job.ID, err)
+			}
+		}
+	}
+}
+
+func watchJob(ctx context.Context, job Job) error {
+	changed := false
+	finished := true
+	for i, f := range job.Files {
+		meta, err := Store().Get(f.Path)
+		if err != nil && err != ErrTaskNotFound {
+			return err
+		}
+		if err == nil && meta.Status != f.Status {
+			job.Files[i].Status = meta.Status
+			changed = true
+		}
+		// 重试用完或被取消的文件保留在本地, 不会再完成
+		if err == nil && meta.Status == TaskErr {
+			job.Status = JobFailed
+			job.Error = fmt.Sprintf("%v: %v", f.Path, meta.Error)
+			changed = true
+			break
+		}
+
+		if f.Finished {
+			continue
+		}
+		_, err = os.Stat(f.Path)
+		if err == nil {
+			finished = false
+			continue
+		}
+		if os.IsNotExist(err) {
+			log.Infof(log.Fields{}, "%v of job %v finished", f.Path, job.ID)
+			job.Files[i].Finished = true
+			changed = true
+			continue
+		}
+		log.Errorf(log.Fields{}, "CANNOT determine %v's stat: %v", f.Path, err)
+		job.Status = JobFailed
+		job.Error = err.Error()
+		changed = true
+		break
+	}
+
+	if !changed {
+		return nil
+	}
+	if finished && job.Status == JobRunning {
+		job.Status = JobDone
+	}
+	job.UpdatedAt = time.Now().Unix()
+	if err := putJob(job); err != nil {
+		return err
+	}
+	if job.Status != JobRunning {
+		publishJob(job)
+		notifyJob(ctx, job)
+	}
+	return nil
+}
+
+func publishJob(job Job) {
+	typ := event.DirCompleted
+	if job.Status == JobFailed {
+		typ = event.DirFailed
+	}
+	event.Publish(event.Event{
+		Type:    typ,
+		Dir:     job.Dir,
+		Error:   job.Error,
+		Message: fmt.Sprintf("job %v %v, %v files", job.ID, job.Status, len(job.Files)),
+	})
+}
+
+// notifyJob 任务结束后通知 plotter
+func notifyJob(ctx context.Context, job Job) {
+	if job.NotifyURL == "" {
+		return
+	}
+	log.Infof(log.Fields{}, "notify job %v %v -> %v", job.ID, job.Status, job.NotifyURL)
+	ctx, cancel := RequestContext(ctx)
+	defer cancel()
+	_, err := httpdaemon.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(job).
+		Post(job.NotifyURL)
+	if err != nil {
+		log.Errorf(log.Fields{}, "fail to notify job %v -> %v: %v", job.ID, job.NotifyURL, err)
+	}
+}
@@ -0,0 +1,142 @@
+package task
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+)
+
+const DefaultLeaseTTL = 60
+
+// ErrLeaseHeld 任务正在被其他 worker 处理
+var ErrLeaseHeld = errors.New("task leased by another worker")
+
+var (
+	leasesReclaimed = metrics.NewCounter("spacemesh_proxy_task_leases_reclaimed_total", "Expired task leases claimed again")
+	leasesLost      = metrics.NewCounter("spacemesh_proxy_task_leases_lost_total", "Task leases that could not be renewed")
+)
+
+// lease 当前进程的 worker 标识及租约时长
+type lease struct {
+	owner string
+	ttl   time.Duration
+	lock  sync.RWMutex
+}
+
+var globalLease = &lease{
+	owner: newLeaseOwner(),
+	ttl:   DefaultLeaseTTL * time.Second,
+}
+
+// newLeaseOwner 主机名, 进程号及随机数, 重启后与之前的租约不同
+func newLeaseOwner() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%v-%v-%v", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// SetLeaseTTL 设置租约时长, 单位秒, 处理中每 1/3 时长续约一次
+func SetLeaseTTL(seconds int) {
+	if seconds <= 0 {
+		seconds = DefaultLeaseTTL
+	}
+	globalLease.lock.Lock()
+	globalLease.ttl = time.Duration(seconds) * time.Second
+	globalLease.lock.Unlock()
+}
+
+func leaseTTL() time.Duration {
+	globalLease.lock.RLock()
+	defer globalLease.lock.RUnlock()
+	return globalLease.ttl
+}
+
+// Claim 状态为 status 且没有有效租约时取得租约, 过期的租约可以被重新取得
+func Claim(path string, status uint8) (Meta, error) {
+	now := time.Now()
+	reclaimed := ""
+	meta, err := Store().Update(path, func(meta *Meta) error {
+		if meta.Status != status {
+			return fmt.Errorf("%v %v -> %v: %w", path, StatusName(status), StatusName(meta.Status), ErrStatusConflict)
+		}
+		if meta.LeaseOwner != "" && meta.LeaseOwner != globalLease.owner {
+			if now.Unix() < meta.LeaseExpiry {
+				return ErrLeaseHeld
+			}
+			reclaimed = meta.LeaseOwner
+		}
+		meta.LeaseOwner = globalLease.owner
+		meta.LeaseExpiry = now.Add(leaseTTL()).Unix()
+		return nil
+	})
+	if err != nil {
+		return meta, err
+	}
+	if reclaimed != "" {
+		log.Infof(log.Fields{}, "reclaim expired lease of %v from %v", path, reclaimed)
+		leasesReclaimed.Inc()
+	}
+	return meta, nil
+}
+
+// checkLease 在队列发起的变更的事务中校验租约仍属于当前进程
+// 租约过期后已被其他 worker 取得时拒绝, 避免覆盖对方的处理结果
+func checkLease(meta *Meta) error {
+	if meta.LeaseOwner != globalLease.owner {
+		return fmt.Errorf("%v leased by %q: %w", meta.Path, meta.LeaseOwner, ErrLeaseHeld)
+	}
+	return nil
+}
+
+func renewLease(path string) error {
+	_, err := Store().Update(path, func(meta *Meta) error {
+		if meta.LeaseOwner != globalLease.owner {
+			return ErrLeaseHeld
+		}
+		meta.LeaseExpiry = time.Now().Add(leaseTTL()).Unix()
+		return nil
+	})
+	return err
+}
+
+// releaseLease 任务已删除或租约已被取得时忽略
+func releaseLease(path string) {
+	_, err := Store().Update(path, func(meta *Meta) error {
+		if meta.LeaseOwner != globalLease.owner {
+			return nil
+		}
+		meta.LeaseOwner = ""
+		meta.LeaseExpiry = 0
+		return nil
+	})
+	if err != nil && err != ErrTaskNotFound {
+		log.Errorf(log.Fields{}, "fail to release lease of %v: %v", path, err)
+	}
+}
+
+// holdLease 在 done 关闭前定期续约, 续约失败后调用 lost 并不再续约
+func holdLease(path string, done <-chan struct{}, lost func()) {
+	ticker := time.NewTicker(leaseTTL() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		if err := renewLease(path); err != nil {
+			log.Errorf(log.Fields{}, "lost lease of %v: %v", path, err)
+			leasesLost.Inc()
+			lost()
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package task
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+	"github.com/boltdb/bolt"
+)
+
+// PutPlacement 记录 PoST 目录的去向, 同一节点的同一目录覆盖之前的记录
+func PutPlacement(placement types.Placement) error {
+	_, err := putIfAbsent(db.PlacementBucket, db.PlacementKey(placement.NodeID, placement.LocalPath), placement, true)
+	return err
+}
+
+// ListPlacements nodeID 按前缀匹配, host 为目录中任一文件所在的存储节点, 为空时不过滤
+// 结果按传输时间排序
+func ListPlacements(nodeID, host string) ([]types.Placement, error) {
+	placements := []types.Placement{}
+	err := db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(nodeID)
+		c := tx.Bucket(db.PlacementBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			placement := types.Placement{}
+			if err := json.Unmarshal(v, &placement); err != nil {
+				log.Errorf(log.Fields{}, "invalid placement %q: %v", string(k), err)
+				continue
+			}
+			if host != "" && !containsString(placement.Hosts, host) {
+				continue
+			}
+			placements = append(placements, placement)
+		}
+		return nil
+	})
+	sort.Slice(placements, func(i, j int) bool {
+		return placements[i].TransferredAt < placements[j].TransferredAt
+	})
+	return placements, err
+}
+
+func containsString(ss []string, s string) bool {
+	for _, _s := range ss {
+		if _s == s {
+			return true
+		}
+	}
+	return false
+}
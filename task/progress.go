@@ -0,0 +1,279 @@
+package task
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/types"
+)
+
+// 发送的字节数及速度每隔一段时间写入任务
+const progressFlushInterval = 5 * time.Second
+
+// sendfile 每次发送的字节数, 发送完一块更新一次进度
+const progressChunk = 8 << 20
+
+var (
+	bytesServed     = metrics.NewCounter("spacemesh_proxy_plot_bytes_served_total", "Bytes of plot files served to storage servers")
+	activeTransfers = metrics.NewGauge("spacemesh_proxy_plot_active_transfers", "Plot file requests being served")
+)
+
+// transfer 一个文件的发送进度, served 从重新派发时开始累计
+type transfer struct {
+	served   uint64
+	active   int32
+	servedAt int64
+	// 以下只在 flush 中使用
+	flushed uint64
+	rate    float64
+}
+
+type progressTracker struct {
+	transfers map[string]*transfer
+	lock      sync.Mutex
+}
+
+var globalProgress = &progressTracker{
+	transfers: map[string]*transfer{},
+}
+
+func init() {
+	// 重新派发时从头统计, 不再传输的任务不再统计
+	OnTransition(func(ev TransitionEvent) {
+		globalProgress.remove(ev.Path)
+		if ev.To != TaskTodo {
+			return
+		}
+		if _, err := Store().Update(ev.Path, func(m *Meta) error {
+			m.Served = 0
+			m.Throughput = 0
+			m.ServedAt = 0
+			return nil
+		}); err != nil {
+			log.Errorf(log.Fields{}, "fail to reset progress of %v: %v", ev.Path, err)
+		}
+	}, TaskTodo, TaskFinish, TaskDone, TaskErr)
+}
+
+// get 重启后从任务中记录的进度继续累计
+func (p *progressTracker) get(path string) *transfer {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	t, ok := p.transfers[path]
+	if ok {
+		return t
+	}
+	t = &transfer{}
+	if meta, err := Store().Get(path); err == nil {
+		t.served = meta.Served
+		t.flushed = meta.Served
+		t.servedAt = meta.ServedAt
+	}
+	p.transfers[path] = t
+	return t
+}
+
+func (p *progressTracker) remove(path string) {
+	p.lock.Lock()
+	delete(p.transfers, path)
+	p.lock.Unlock()
+}
+
+func (p *progressTracker) snapshot() map[string]*transfer {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	transfers := make(map[string]*transfer, len(p.transfers))
+	for path, t := range p.transfers {
+		transfers[path] = t
+	}
+	return transfers
+}
+
+// flush 写入有变化的进度, 任务已不存在时不再统计
+func (p *progressTracker) flush(interval time.Duration) {
+	for path, t := range p.snapshot() {
+		served := atomic.LoadUint64(&t.served)
+		delta := served - t.flushed
+		if delta == 0 && t.rate == 0 {
+			continue
+		}
+		t.flushed = served
+		t.rate = float64(delta) / interval.Seconds()
+
+		rate := t.rate
+		servedAt := atomic.LoadInt64(&t.servedAt)
+		meta, err := Store().Update(path, func(m *Meta) error {
+			m.Served = served
+			m.Throughput = rate
+			m.ServedAt = servedAt
+			return nil
+		})
+		if err == ErrTaskNotFound {
+			p.remove(path)
+			continue
+		}
+		if err != nil {
+			log.Errorf(log.Fields{}, "fail to record progress of %v: %v", path, err)
+			continue
+		}
+		event.Publish(event.Event{
+			Type: event.TaskProgress,
+			Path: path,
+			Dir:  meta.Dir(),
+			Host: meta.Host,
+			Data: types.TaskProgress{
+				Size:       meta.Size,
+				Served:     served,
+				Throughput: rate,
+				Active:     atomic.LoadInt32(&t.active) > 0,
+			},
+		})
+	}
+}
+
+func flushProgress(ctx context.Context) {
+	ticker := time.NewTicker(progressFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			globalProgress.flush(progressFlushInterval)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type progressWriter struct {
+	http.ResponseWriter
+	t *transfer
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.add(int64(n))
+	return n, err
+}
+
+// ReadFrom 交给 ResponseWriter 以保留 sendfile, 按 progressChunk 分块以便发送期间更新进度
+// http.ServeContent 传入的是 *io.LimitedReader{R: *os.File}, 每块同样以 *os.File 为底
+func (w *progressWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := w.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{w}, src)
+	}
+	lr, limited := src.(*io.LimitedReader)
+	total := int64(0)
+	for {
+		chunk := &io.LimitedReader{R: src, N: progressChunk}
+		if limited {
+			if lr.N <= 0 {
+				return total, nil
+			}
+			chunk.R = lr.R
+			if lr.N < chunk.N {
+				chunk.N = lr.N
+			}
+		}
+		want := chunk.N
+		n, err := rf.ReadFrom(chunk)
+		if limited {
+			lr.N -= n
+		}
+		total += n
+		w.add(n)
+		if err != nil || n < want {
+			return total, err
+		}
+	}
+}
+
+func (w *progressWriter) add(n int64) {
+	atomic.AddUint64(&w.t.served, uint64(n))
+	atomic.StoreInt64(&w.t.servedAt, time.Now().Unix())
+	bytesServed.Add(float64(n))
+}
+
+// writerOnly 隐藏 ReadFrom, 避免 io.Copy 递归调用
+type writerOnly struct {
+	io.Writer
+}
+
+// ServeProgress 统计文件服务发送的每个文件的字节数, 需要在 StripPrefix 之前
+func ServeProgress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, PlotFileHandle) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		t := globalProgress.get(strings.TrimPrefix(req.URL.Path, PlotFilePrefix))
+		atomic.AddInt32(&t.active, 1)
+		activeTransfers.Add(1)
+		defer func() {
+			atomic.AddInt32(&t.active, -1)
+			activeTransfers.Add(-1)
+		}()
+		next.ServeHTTP(&progressWriter{ResponseWriter: w, t: t}, req)
+	})
+}
+
+// Progress 按目录汇总未完成的任务的进度, dir 为空时返回所有目录
+// 速度取最近仍在发送的任务之和, 为 0 时无法估计剩余时间, ETA 为 -1
+func Progress(dir string) ([]types.DirProgress, error) {
+	var metas []Meta
+	var err error
+	if dir != "" {
+		metas, err = Store().ListByDir(dir)
+	} else {
+		metas, err = Store().ListByStatus(TaskTodo, TaskWait)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	stale := int64(2 * progressFlushInterval / time.Second)
+	dirs := map[string]*types.DirProgress{}
+	order := []string{}
+	for _, m := range metas {
+		if m.Status != TaskTodo && m.Status != TaskWait {
+			continue
+		}
+		d, ok := dirs[m.Dir()]
+		if !ok {
+			d = &types.DirProgress{Dir: m.Dir()}
+			dirs[m.Dir()] = d
+			order = append(order, m.Dir())
+		}
+		d.Files++
+		d.Size += m.Size
+		served := m.Served
+		if m.Size > 0 && served > m.Size {
+			served = m.Size
+		}
+		d.Served += served
+		if m.Status == TaskWait && now-m.ServedAt <= stale && m.Throughput > 0 {
+			d.Transferring++
+			d.Throughput += m.Throughput
+		}
+	}
+
+	progress := []types.DirProgress{}
+	for _, dir := range order {
+		d := dirs[dir]
+		d.ETA = -1
+		if d.Throughput > 0 && d.Size >= d.Served {
+			d.ETA = int64(float64(d.Size-d.Served) / d.Throughput)
+		}
+		progress = append(progress, *d)
+	}
+	return progress, nil
+}
@@ -1,13 +1,12 @@
 package task
 
 import (
-	"encoding/json"
+	"context"
 	"sync"
 	"time"
 
 	log "github.com/EntropyPool/entropy-logger"
-	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
-	"github.com/boltdb/bolt"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
 )
 
 var (
@@ -15,7 +14,14 @@ var (
 )
 
 const (
-	DefaultQSize = 1 << 8
+	DefaultWorkers = 100
+	DefaultBacklog = 1 << 12
+)
+
+var (
+	queuePending  = metrics.NewGauge("spacemesh_proxy_queue_pending", "Tasks waiting in the in-memory backlog")
+	queueActive   = metrics.NewGauge("spacemesh_proxy_queue_active", "Tasks being processed")
+	queueDeferred = metrics.NewCounter("spacemesh_proxy_queue_deferred_total", "Tasks left in the database because the backlog was full")
 )
 
 const (
@@ -28,84 +34,201 @@ const (
 )
 
 type Meta struct {
+	// 本地文件路径, 任务的键
+	Path      string `json:"path"`
 	Status    uint8  `json:"status"`
 	Host      string `json:"host"`
 	PlotURL   string `json:"plot_url"`
 	FailURL   string `json:"fail_url"`
 	FinishURL string `json:"finish_url"`
 	DiskSpace uint64 `json:"disk_space"`
+	// 文件大小及入库时间, 用于调度排序
+	Size      uint64 `json:"size"`
+	CreatedAt int64  `json:"created_at"`
+	// 最近一次状态变更的时间
+	UpdatedAt int64 `json:"updated_at"`
+	// 存储节点完成时上报的存放路径及校验和
+	RemotePath string `json:"remote_path,omitempty"`
+	Checksum   string `json:"checksum,omitempty"`
+	// 正在处理的 worker 及租约到期时间, 进程崩溃后租约过期即可被重新处理
+	LeaseOwner  string `json:"lease_owner,omitempty"`
+	LeaseExpiry int64  `json:"lease_expiry,omitempty"`
+	// 文件服务已发送的字节数, 最近的速度 (字节每秒) 及最后发送的时间, 重新派发时清零
+	Served     uint64  `json:"served,omitempty"`
+	Throughput float64 `json:"throughput,omitempty"`
+	ServedAt   int64   `json:"served_at,omitempty"`
+	// 最近一次处理失败的原因 (timeout, cancelled, request, panic) 及错误, panic 时包含调用栈
+	FailReason string `json:"fail_reason,omitempty"`
+	Error      string `json:"error,omitempty"`
+	FailedAt   int64  `json:"failed_at,omitempty"`
+	// 重新派发的次数及下一次派发的时间
+	Retries     int   `json:"retries,omitempty"`
+	NextRetryAt int64 `json:"next_retry_at,omitempty"`
 }
 
 type queue struct {
-	// 记录已经在队列中的
+	// 记录已经在队列中或正在执行的
 	added map[string]struct{}
-	// TODO 默认这里的任务数量不会大于 1 << 8
-	qsize    uint8
-	q        chan Meta
-	callback map[uint8]func(Meta)
+	// 等待执行的任务, 每次拉取后按调度条件排序, 超过 backlog 的留在数据库中由下一次 fetch 拉取
+	pending []Meta
+	backlog int
+	// 同时执行的任务数
+	workers int
+	active  int
+	wake    chan struct{}
+	// 每个状态可以有多个处理函数, 按添加顺序执行
+	callback map[uint8][]Handler
+	// 停止时取消所有正在执行的任务, cancels 按路径取消单个任务
+	ctx     context.Context
+	cancel  context.CancelFunc
+	cancels map[string]context.CancelFunc
+
+	// 停止后不再拉取和执行新的任务
+	done    chan struct{}
+	stopped bool
+	// 正在执行的任务
+	running sync.WaitGroup
 
 	// lock
 	lock sync.Mutex
 }
 
 type Qer interface {
-	Add(Meta)
-	AddCallBack(uint8, func(Meta))
-	// TODO 清理已经是 DONE 的 key
+	// Add 不阻塞, backlog 已满时返回 false, 任务留在数据库中
+	Add(Meta) bool
+	AddCallBack(uint8, Handler)
+	// Handled 返回已添加处理函数的状态
+	Handled() []uint8
+	// 执行完成后移除, DONE 的任务由 ArchiveTasks 归档
 	IsAdded(key string) bool
+	// Cancel 取消正在执行的任务, 任务不在执行时返回 false
+	Cancel(key string) bool
+	// Backlog 返回等待及正在执行的任务数
+	Backlog() (pending, active int)
 	//delete map
 	delKey(string)
 	// fetch
 	fetch()
 	// run
 	run()
+	// Stop 停止拉取任务, 等待正在执行的任务完成
+	Stop(ctx context.Context) error
 }
 
 // 对外提供的方法
-func Add(m Meta) {
-	globalQueue.Add(m)
+func Add(m Meta) bool {
+	return globalQueue.Add(m)
 }
-func AddCallBack(s uint8, f func(Meta)) {
+func AddCallBack(s uint8, f Handler) {
 	globalQueue.AddCallBack(s, f)
 }
 func IsAdded(key string) bool {
 	return globalQueue.IsAdded(key)
 }
+func Backlog() (pending, active int) {
+	return globalQueue.Backlog()
+}
+func Stop(ctx context.Context) error {
+	return globalQueue.Stop(ctx)
+}
 
-// 初始化任务队列
-func NewQueue(qsize int) {
-	if qsize <= 0 {
-		qsize = DefaultQSize
-	}
-	globalQueue = &queue{
-		q:        make(chan Meta, qsize),
-		added:    make(map[string]struct{}),
-		callback: make(map[uint8]func(Meta)),
-	}
+// 初始化任务队列, workers 为同时执行的任务数, backlog 为内存中等待的任务数
+func NewQueue(workers, backlog int) {
+	q := newQueue(workers, backlog)
+	globalQueue = q
 	// 拉取数据的任务
 	go globalQueue.fetch()
 	// 执行任务
 	go globalQueue.run()
+	// 等待目录任务完成
+	go watchJobs(q.ctx)
+	// 记录文件的发送进度
+	go flushProgress(q.ctx)
+	// 重新派发停滞的任务
+	go watchStalled(q.ctx)
 }
 
-// Add 添加数据
-func (q *queue) Add(meta Meta) {
+func newQueue(workers, backlog int) *queue {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if backlog <= 0 {
+		backlog = DefaultBacklog
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &queue{
+		added:    make(map[string]struct{}),
+		backlog:  backlog,
+		workers:  workers,
+		wake:     make(chan struct{}, 1),
+		callback: make(map[uint8][]Handler),
+		ctx:      ctx,
+		cancel:   cancel,
+		cancels:  make(map[string]context.CancelFunc),
+		done:     make(chan struct{}),
+	}
+	return q
+}
+
+// Add 添加数据, 不持锁发送, 不阻塞调用方
+func (q *queue) Add(meta Meta) bool {
 	q.lock.Lock()
-	if _, ok := q.added[meta.PlotURL]; !ok {
-		q.added[meta.PlotURL] = struct{}{}
+	if q.stopped {
+		q.lock.Unlock()
+		return false
 	}
-	// 假设队列足够长
-	q.q <- meta
+	if _, ok := q.added[meta.Path]; ok {
+		q.lock.Unlock()
+		return true
+	}
+	if len(q.pending) >= q.backlog {
+		q.lock.Unlock()
+		queueDeferred.Inc()
+		return false
+	}
+	q.added[meta.Path] = struct{}{}
+	q.pending = append(q.pending, meta)
+	pending := len(q.pending)
 	q.lock.Unlock()
+
+	queuePending.Set(float64(pending))
+	q.signal()
+	return true
 }
 
-// AddCallBack 添加处理函数
-func (q *queue) AddCallBack(status uint8, callback func(meta Meta)) {
+// signal 唤醒 run, 已有未处理的唤醒时直接返回
+func (q *queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// AddCallBack 添加处理函数, 同一状态的处理函数依次执行
+func (q *queue) AddCallBack(status uint8, callback Handler) {
 	q.lock.Lock()
-	q.callback[status] = callback
+	q.callback[status] = append(q.callback[status], callback)
 	q.lock.Unlock()
 }
 
+func (q *queue) handlers(status uint8) []Handler {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.callback[status]
+}
+
+func (q *queue) Handled() []uint8 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	statuses := []uint8{}
+	for _, s := range Statuses() {
+		if len(q.callback[s]) > 0 {
+			statuses = append(statuses, s)
+		}
+	}
+	return statuses
+}
+
 // IsAdded 校验已添加
 func (q *queue) IsAdded(key string) bool {
 	q.lock.Lock()
@@ -113,51 +236,184 @@ func (q *queue) IsAdded(key string) bool {
 	q.lock.Unlock()
 	return ok
 }
+
+func (q *queue) Cancel(key string) bool {
+	q.lock.Lock()
+	cancel, ok := q.cancels[key]
+	q.lock.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+func (q *queue) Backlog() (int, int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending), q.active
+}
+
 func (q *queue) delKey(key string) {
 	q.lock.Lock()
 	delete(q.added, key)
 	q.lock.Unlock()
 }
+
+// next 取出下一个任务, 没有任务或 worker 已满时返回 false
+func (q *queue) next() (Meta, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.stopped || len(q.pending) == 0 || q.active >= q.workers {
+		return Meta{}, false
+	}
+	m := q.pending[0]
+	q.pending[0] = Meta{}
+	q.pending = q.pending[1:]
+	q.active++
+	q.running.Add(1)
+	queuePending.Set(float64(len(q.pending)))
+	queueActive.Set(float64(q.active))
+	return m, true
+}
+
 func (q *queue) run() {
 	for {
 		select {
-		case m := <-q.q:
-			go func() {
-				defer q.delKey(m.PlotURL)
-				// 这里需要小心 可以使用 ok 形式
-				q.callback[m.Status](m)
-			}()
+		case <-q.wake:
+		case <-q.done:
+			return
 		}
+		for {
+			m, ok := q.next()
+			if !ok {
+				break
+			}
+			go q.exec(m)
+		}
+	}
+}
+
+func (q *queue) exec(m Meta) {
+	ctx, cancel := context.WithCancel(q.ctx)
+	q.lock.Lock()
+	q.cancels[m.Path] = cancel
+	q.lock.Unlock()
+	defer func() {
+		cancel()
+		q.lock.Lock()
+		delete(q.cancels, m.Path)
+		delete(q.added, m.Path)
+		q.active--
+		active := q.active
+		q.lock.Unlock()
+		queueActive.Set(float64(active))
+		q.running.Done()
+		// 空出 worker 后继续执行等待的任务
+		q.signal()
+	}()
+	handlers := q.handlers(m.Status)
+	if len(handlers) == 0 {
+		dispatch(ctx, m, nil)
+		return
+	}
+	// 入队后状态可能已被回调修改, 例如 Upload 前已经完成, 或正在被其他 worker 处理
+	cur, err := Claim(m.Path, m.Status)
+	if err != nil {
+		log.Infof(log.Fields{}, "skip %v: %v", m.Path, err)
+		return
 	}
+	done := make(chan struct{})
+	// 租约被其他 worker 取得后停止处理
+	go holdLease(m.Path, done, cancel)
+	defer func() {
+		close(done)
+		releaseLease(m.Path)
+	}()
+	dispatch(ctx, cur, handlers)
 }
 
 func (q *queue) fetch() {
 	// 每五分钟拉取一次数据
-	for range time.NewTicker(time.Second * 10).C {
-		bdb, err := db.BoltClient()
-		if err != nil {
-			log.Errorf(log.Fields{}, "get bolt database client error %v", err)
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.done:
+			return
+		}
+		if _, err := q.fetchOnce(); err != nil {
+			log.Errorf(log.Fields{}, "fetch tasks to queue error %v", err)
+		}
+	}
+}
+
+// fetchOnce 拉取一次任务, 返回入队的任务数
+func (q *queue) fetchOnce() (int, error) {
+	priorities, err := Priorities()
+	if err != nil {
+		return 0, err
+	}
+	// 只拉取有处理函数的状态, err 的任务由运维处理
+	todo, err := Store().ListByStatus(q.Handled()...)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	metas := []Meta{}
+	for _, meta := range todo {
+		// 等待退避结束后再重试
+		if meta.Status == TaskTodo && meta.NextRetryAt > now {
 			continue
 		}
+		if !q.IsAdded(meta.Path) {
+			metas = append(metas, meta)
+		}
+	}
 
-		if err := bdb.View(func(tx *bolt.Tx) error {
-			bk := tx.Bucket(db.DefaultBucket)
-			return bk.ForEach(func(k, v []byte) error {
-				meta := Meta{}
-				if err := json.Unmarshal(v, &meta); err != nil {
-					log.Errorf(log.Fields{}, "fetch bolt data to queue error %v", err)
-					return nil
-				}
-				if !IsAdded(meta.PlotURL) &&
-					(meta.Status != TaskDone &&
-						meta.Status != TaskWait) {
-					// TODO 同步数据优化
-					globalQueue.Add(meta)
-				}
-				return nil
-			})
-		}); err != nil {
-			log.Errorf(log.Fields{}, "fetch bolt data to queue error %v", err)
+	// 按调度条件排序后入队, 不在事务中阻塞, backlog 满后其余任务等待下一次拉取
+	globalScheduler.sortMetas(metas, priorities)
+	queued := len(metas)
+	for i, meta := range metas {
+		if !q.Add(meta) {
+			pending, active := q.Backlog()
+			log.Infof(log.Fields{}, "queue backlog full (pending %v, active %v), defer %v tasks", pending, active, len(metas)-i)
+			queued = i
+			break
 		}
 	}
+	q.sortPending(priorities)
+	return queued, nil
+}
+
+// sortPending 新入队的任务与 backlog 中已有的一起按调度条件排序, 优先级变更后等待中的任务也按新的顺序执行
+func (q *queue) sortPending(priorities map[string]int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	globalScheduler.sortMetas(q.pending, priorities)
+}
+
+// Stop 停止后未完成的任务保留在数据库中, 重启后继续执行
+func (q *queue) Stop(ctx context.Context) error {
+	q.lock.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.done)
+	}
+	q.lock.Unlock()
+	// 取消正在进行的请求, 未完成的任务保持原状态并释放租约
+	q.cancel()
+
+	finished := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,288 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+)
+
+const (
+	// 积压的 todo 任务数, 超过默认的 backlog
+	seedTodo = 12000
+	seedWait = 100
+	// 一次拉取及一次回调的时间上限
+	fetchDeadline    = 2 * time.Second
+	callbackDeadline = 2 * time.Second
+)
+
+// setupQueueTest 使用内存存储, 优先级等仍在 bolt 中, 测试结束后恢复原来的存储
+func setupQueueTest(t *testing.T) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "queue_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.InitBoltClient(filepath.Join(dir, "test.db"))
+	prev := globalStore
+	globalStore = NewMemoryStore()
+	t.Cleanup(func() {
+		globalStore = prev
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	now := time.Now().Unix()
+	for i := 0; i < seedTodo; i++ {
+		seedTask(t, Meta{
+			Path:      fmt.Sprintf("/plots/post-%02d/postdata_%d.bin", i%50, i),
+			Status:    TaskTodo,
+			Host:      "127.0.0.1",
+			Size:      uint64(i),
+			CreatedAt: now,
+		})
+	}
+	for i := 0; i < seedWait; i++ {
+		seedTask(t, Meta{
+			Path:      fmt.Sprintf("/plots/wait/postdata_%d.bin", i),
+			Status:    TaskWait,
+			Host:      "127.0.0.1",
+			CreatedAt: now,
+		})
+	}
+}
+
+func seedTask(t *testing.T, meta Meta) {
+	t.Helper()
+	if err := Store().Add(meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func noopHandler(ctx context.Context, meta Meta) {}
+
+func TestFetchBoundedByBacklog(t *testing.T) {
+	cases := []struct {
+		name    string
+		backlog int
+		want    int
+	}{
+		{"small backlog", 100, 100},
+		{"default backlog", 0, DefaultBacklog},
+		{"backlog larger than todo", 2 * seedTodo, seedTodo},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupQueueTest(t)
+			q := newQueue(1, c.backlog)
+			q.AddCallBack(TaskTodo, noopHandler)
+
+			for pass := 0; pass < 2; pass++ {
+				start := time.Now()
+				queued, err := q.fetchOnce()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if elapsed := time.Since(start); elapsed > fetchDeadline {
+					t.Errorf("pass %v took %v, want < %v", pass, elapsed, fetchDeadline)
+				}
+				// 第二次拉取时已入队的任务跳过, backlog 已满时不再入队
+				want := c.want
+				if pass > 0 {
+					want = 0
+				}
+				if queued != want {
+					t.Errorf("pass %v queued %v, want %v", pass, queued, want)
+				}
+				pending, active := q.Backlog()
+				if pending != c.want || active != 0 {
+					t.Errorf("pass %v backlog (%v, %v), want (%v, 0)", pass, pending, active, c.want)
+				}
+				if len(q.added) != c.want {
+					t.Errorf("pass %v added %v, want %v", pass, len(q.added), c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPendingFollowsPriority(t *testing.T) {
+	setupQueueTest(t)
+	q := newQueue(1, 100)
+	q.AddCallBack(TaskTodo, noopHandler)
+	if _, err := q.fetchOnce(); err != nil {
+		t.Fatal(err)
+	}
+
+	// backlog 已满, 提高排在最后的目录的优先级后, 已入队的任务也排到前面
+	dir := q.pending[len(q.pending)-1].Dir()
+	if err := SetPriority(dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	if queued, err := q.fetchOnce(); err != nil || queued != 0 {
+		t.Fatalf("fetch queued %v, err %v", queued, err)
+	}
+	n := 0
+	for _, meta := range q.pending {
+		if meta.Dir() == dir {
+			n++
+		}
+	}
+	for i, meta := range q.pending[:n] {
+		if meta.Dir() != dir {
+			t.Errorf("pending[%v] in %v, want %v", i, meta.Dir(), dir)
+		}
+	}
+}
+
+func TestCallbacksWhileSaturated(t *testing.T) {
+	const workers, backlog = 4, 100
+
+	cases := []struct {
+		name string
+		// 选择回调的任务, 在 wait 中, 在 backlog 中或正在处理
+		path func(q *queue, i int) string
+		call func(path string) error
+		want uint8
+	}{
+		{
+			name: "finish waiting task",
+			path: waitingPath,
+			call: storageFinish,
+			want: TaskFinish,
+		},
+		{
+			name: "fail waiting task",
+			path: waitingPath,
+			call: storageFail,
+			want: TaskTodo,
+		},
+		{
+			name: "finish pending task",
+			path: func(q *queue, i int) string {
+				q.lock.Lock()
+				defer q.lock.Unlock()
+				return q.pending[i].Path
+			},
+			call: storageFinish,
+			want: TaskFinish,
+		},
+		{
+			name: "finish active task",
+			path: activePath,
+			call: storageFinish,
+			want: TaskFinish,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupQueueTest(t)
+			release := make(chan struct{})
+			q := newQueue(workers, backlog)
+			q.AddCallBack(TaskTodo, func(ctx context.Context, meta Meta) {
+				select {
+				case <-release:
+				case <-ctx.Done():
+				}
+			})
+			q.AddCallBack(TaskFinish, noopHandler)
+			go q.run()
+			t.Cleanup(func() {
+				close(release)
+				ctx, cancel := context.WithTimeout(context.Background(), callbackDeadline)
+				defer cancel()
+				if err := q.Stop(ctx); err != nil {
+					t.Errorf("stop queue: %v", err)
+				}
+			})
+
+			saturate(t, q, workers, backlog)
+
+			for i := 0; i < workers-1; i++ {
+				path := c.path(q, i)
+				if path == "" {
+					t.Fatal("no task to call back")
+				}
+				done := make(chan error, 1)
+				go func() {
+					done <- c.call(path)
+				}()
+				select {
+				case err := <-done:
+					if err != nil {
+						t.Fatalf("%v: %v", path, err)
+					}
+				case <-time.After(callbackDeadline):
+					t.Fatalf("%v: callback blocked for %v", path, callbackDeadline)
+				}
+				meta, err := Store().Get(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if meta.Status != c.want {
+					t.Errorf("%v status %v, want %v", path, StatusName(meta.Status), StatusName(c.want))
+				}
+			}
+
+			// 仍然饱和时拉取不入队, 也不阻塞
+			start := time.Now()
+			if queued, err := q.fetchOnce(); err != nil || queued != 0 {
+				t.Errorf("fetch while saturated queued %v, err %v", queued, err)
+			}
+			if elapsed := time.Since(start); elapsed > fetchDeadline {
+				t.Errorf("fetch while saturated took %v, want < %v", elapsed, fetchDeadline)
+			}
+		})
+	}
+}
+
+func waitingPath(q *queue, i int) string {
+	return fmt.Sprintf("/plots/wait/postdata_%d.bin", i)
+}
+
+// activePath 返回一个正在处理且仍为 todo 的任务
+func activePath(q *queue, i int) string {
+	metas, _ := Store().ListByStatus(TaskTodo)
+	for _, meta := range metas {
+		if meta.LeaseOwner == globalLease.owner {
+			return meta.Path
+		}
+	}
+	return ""
+}
+
+// storageFinish 与存储节点的完成回调相同
+func storageFinish(path string) error {
+	_, err := Transition(path, Trigger{Actor: ActorStorage}, TaskFinish, TaskTodo, TaskWait)
+	return err
+}
+
+// storageFail 与存储节点的失败回调相同
+func storageFail(path string) error {
+	return Retry(path, Trigger{Actor: ActorStorage, Error: "storage failed"})
+}
+
+// saturate 拉取一次, 等待所有 worker 都在处理且 backlog 已满
+func saturate(t *testing.T, q *queue, workers, backlog int) {
+	t.Helper()
+	deadline := time.Now().Add(fetchDeadline)
+	for {
+		if _, err := q.fetchOnce(); err != nil {
+			t.Fatal(err)
+		}
+		pending, active := q.Backlog()
+		if pending == backlog && active == workers {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue not saturated: pending %v, active %v", pending, active)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,246 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+)
+
+const (
+	DefaultStallTimeout     = 10 * 60
+	DefaultRetryBackoffBase = 60
+	DefaultRetryBackoffMax  = 60 * 60
+	// 不限制重试次数时, 失败该次数后发布一次 TaskExhausted 提醒, 任务继续重试
+	RetryAlertAfter = 10
+)
+
+const stallCheckInterval = 30 * time.Second
+
+var (
+	tasksStalled     = metrics.NewCounter("spacemesh_proxy_task_stalled_total", "Waiting tasks with no bytes served within the stall timeout")
+	taskRetries      = metrics.NewCounter("spacemesh_proxy_task_retries_total", "Tasks scheduled to be dispatched again", "reason")
+	retriesExhausted = metrics.NewCounter("spacemesh_proxy_task_retries_exhausted_total", "Tasks marked err after reaching the retry limit")
+)
+
+// RetryPolicy 通知失败或传输停滞后重新派发的策略
+type RetryPolicy struct {
+	// wait 的任务超过该时间没有发送数据视为停滞, 单位秒
+	StallTimeout int
+	// 最多重试的次数, 为 0 时不限制, 超过后任务标记为 err
+	MaxRetries int
+	// 退避时间为 base * 2^(retries-1), 不超过 max, 单位秒
+	BackoffBase int
+	BackoffMax  int
+	// 重试时按 Hosts 的顺序换到下一个存储节点
+	OtherHost bool
+	Hosts     []string
+}
+
+var globalRetry = struct {
+	policy RetryPolicy
+	lock   sync.RWMutex
+}{}
+
+// SetRetryPolicy 设置重试策略, 为 0 的字段使用默认值
+func SetRetryPolicy(policy RetryPolicy) {
+	if policy.StallTimeout <= 0 {
+		policy.StallTimeout = DefaultStallTimeout
+	}
+	if policy.BackoffBase <= 0 {
+		policy.BackoffBase = DefaultRetryBackoffBase
+	}
+	if policy.BackoffMax <= 0 {
+		policy.BackoffMax = DefaultRetryBackoffMax
+	}
+	globalRetry.lock.Lock()
+	globalRetry.policy = policy
+	globalRetry.lock.Unlock()
+}
+
+func retryPolicy() RetryPolicy {
+	globalRetry.lock.RLock()
+	defer globalRetry.lock.RUnlock()
+	if globalRetry.policy.StallTimeout == 0 {
+		return RetryPolicy{
+			StallTimeout: DefaultStallTimeout,
+			BackoffBase:  DefaultRetryBackoffBase,
+			BackoffMax:   DefaultRetryBackoffMax,
+		}
+	}
+	return globalRetry.policy
+}
+
+func (p RetryPolicy) backoff(retries int) int64 {
+	backoff := int64(p.BackoffBase)
+	for i := 1; i < retries && backoff < int64(p.BackoffMax); i++ {
+		backoff *= 2
+	}
+	if backoff > int64(p.BackoffMax) {
+		backoff = int64(p.BackoffMax)
+	}
+	return backoff
+}
+
+// nextHost 返回 Hosts 中 host 的下一个, 不在其中时返回第一个
+func (p RetryPolicy) nextHost(host string) string {
+	if !p.OtherHost || len(p.Hosts) == 0 {
+		return host
+	}
+	for i, h := range p.Hosts {
+		if h == host {
+			return p.Hosts[(i+1)%len(p.Hosts)]
+		}
+	}
+	return p.Hosts[0]
+}
+
+// errRetriesExhausted 重试次数已用完, 改为标记 err
+var errRetriesExhausted = errors.New("retries exhausted")
+
+// retry 记录失败原因并安排下一次派发, 超过重试次数时标记为 err, 任务需为 from
+// from 为 todo 时由队列调用, 需持有租约并保持 todo, 否则改回 todo
+// 失败原因, 重试次数与状态在同一个事务中写入
+// 取消不计入重试
+func retry(path string, by Trigger, from uint8, reason string, cause error) error {
+	if reason == FailCancelled {
+		recordFailure(path, reason, cause)
+		return nil
+	}
+	taskFailures.Inc(reason)
+
+	policy := retryPolicy()
+	schedule := func(m *Meta) error {
+		setFailure(m, reason, cause)
+		m.Retries++
+		if policy.MaxRetries > 0 && m.Retries > policy.MaxRetries {
+			return errRetriesExhausted
+		}
+		m.NextRetryAt = time.Now().Unix() + policy.backoff(m.Retries)
+		m.Host = policy.nextHost(m.Host)
+		return nil
+	}
+	var meta Meta
+	var err error
+	if from == TaskTodo {
+		meta, err = Store().Update(path, func(m *Meta) error {
+			if m.Status != TaskTodo {
+				return ErrStatusConflict
+			}
+			if err := checkLease(m); err != nil {
+				return err
+			}
+			return schedule(m)
+		})
+	} else {
+		meta, err = TransitionUpdate(path, by, TaskTodo, schedule, from)
+	}
+	if err == errRetriesExhausted {
+		return exhaust(path, by, from, reason, cause)
+	}
+	if err != nil {
+		return err
+	}
+
+	if policy.MaxRetries == 0 && meta.Retries == RetryAlertAfter {
+		log.Errorf(log.Fields{}, "%v failed %v times, keep retrying: %v", path, meta.Retries, cause)
+		event.Publish(event.Event{
+			Type:    event.TaskExhausted,
+			Path:    path,
+			Dir:     meta.Dir(),
+			Host:    meta.Host,
+			Error:   cause.Error(),
+			Message: fmt.Sprintf("failed %v times, last reason %v, still retrying", meta.Retries, reason),
+		})
+	}
+	log.Infof(log.Fields{}, "retry %v -> %v at %v (%v)", path, meta.Host, time.Unix(meta.NextRetryAt, 0), reason)
+	taskRetries.Inc(reason)
+	return nil
+}
+
+// exhaust 重试次数用完, 在同一个事务中记录失败并标记为 err
+func exhaust(path string, by Trigger, from uint8, reason string, cause error) error {
+	by = Trigger{Actor: ActorRetry, Remote: by.Remote, Error: cause.Error()}
+	meta, err := TransitionUpdate(path, by, TaskErr, func(m *Meta) error {
+		if from == TaskTodo {
+			if err := checkLease(m); err != nil {
+				return err
+			}
+		}
+		setFailure(m, reason, cause)
+		m.Retries++
+		return nil
+	}, from)
+	if err != nil {
+		return err
+	}
+	log.Errorf(log.Fields{}, "%v failed %v times, give up: %v", path, meta.Retries, cause)
+	retriesExhausted.Inc()
+	event.Publish(event.Event{
+		Type:    event.TaskExhausted,
+		Path:    path,
+		Dir:     meta.Dir(),
+		Host:    meta.Host,
+		Error:   cause.Error(),
+		Message: fmt.Sprintf("failed %v times, last reason %v", meta.Retries, reason),
+	})
+	return nil
+}
+
+// Retry 存储节点报告失败, 将 wait 的任务改回 todo 并按重试策略重新派发
+// 已经完成的任务不受迟到的失败回调影响, 返回 ErrStatusConflict
+func Retry(path string, by Trigger) error {
+	return retryWait(path, by, FailStorage)
+}
+
+func retryWait(path string, by Trigger, reason string) error {
+	return retry(path, by, TaskWait, reason, errors.New(by.Error))
+}
+
+// watchStalled 将停滞的 wait 任务改回 todo 重新派发, 存储节点崩溃后不会调用失败地址
+func watchStalled(ctx context.Context) {
+	ticker := time.NewTicker(stallCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := checkStalled(time.Now().Unix()); err != nil {
+			log.Errorf(log.Fields{}, "fail to check stalled tasks: %v", err)
+		}
+	}
+}
+
+func checkStalled(now int64) error {
+	policy := retryPolicy()
+	metas, err := Store().ListByStatus(TaskWait)
+	if err != nil {
+		return err
+	}
+	for _, m := range metas {
+		// 进入 wait 后还没有发送数据时从进入的时间算起
+		last := m.UpdatedAt
+		if m.ServedAt > last {
+			last = m.ServedAt
+		}
+		idle := now - last
+		if idle < int64(policy.StallTimeout) {
+			continue
+		}
+		// 存储节点可能同时完成, 状态已变更时跳过
+		cause := fmt.Errorf("no bytes served by %v for %vs", m.Host, idle)
+		by := Trigger{Actor: ActorWatchdog, Remote: m.Host, Error: cause.Error()}
+		if err := retryWait(m.Path, by, FailStalled); err != nil {
+			continue
+		}
+		tasksStalled.Inc()
+	}
+	return nil
+}
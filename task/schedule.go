@@ -0,0 +1,167 @@
+package task
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/boltdb/bolt"
+)
+
+// 调度排序条件
+const (
+	// 运维指定的目录优先级, 越大越先
+	OrderPriority = "priority"
+	// 源磁盘剩余空间, 越少越先
+	OrderDiskFree = "disk_free"
+	// 目录入库时间, 越早越先
+	OrderAge = "age"
+	// 文件大小, 越大越先
+	OrderSize = "size"
+)
+
+var DefaultScheduleOrder = []string{OrderPriority, OrderDiskFree, OrderAge, OrderSize}
+
+type scheduler struct {
+	order []string
+	// 返回目录所在磁盘的剩余空间百分比
+	diskFree func(dir string) (float64, bool)
+	lock     sync.Mutex
+}
+
+var globalScheduler = &scheduler{
+	order: DefaultScheduleOrder,
+}
+
+// SetScheduleOrder 设置调度排序条件, 为空时使用默认顺序
+func SetScheduleOrder(order []string) {
+	valid := []string{}
+	for _, o := range order {
+		switch o {
+		case OrderPriority, OrderDiskFree, OrderAge, OrderSize:
+			valid = append(valid, o)
+		default:
+			log.Errorf(log.Fields{}, "unknown schedule order %v, ignore", o)
+		}
+	}
+	if len(valid) == 0 {
+		valid = DefaultScheduleOrder
+	}
+
+	globalScheduler.lock.Lock()
+	globalScheduler.order = valid
+	globalScheduler.lock.Unlock()
+}
+
+// SetDiskFree 设置查询目录所在磁盘剩余空间的方法
+func SetDiskFree(f func(dir string) (float64, bool)) {
+	globalScheduler.lock.Lock()
+	globalScheduler.diskFree = f
+	globalScheduler.lock.Unlock()
+}
+
+// LocalPath 返回任务对应的本地文件
+func (m Meta) LocalPath() string {
+	if m.Path != "" {
+		return m.Path
+	}
+	return PathFromURL(m.PlotURL)
+}
+
+// Dir 返回任务所属的目录
+func (m Meta) Dir() string {
+	return filepath.Dir(m.LocalPath())
+}
+
+// sortMetas 按调度条件排序, priorities 为运维指定的目录优先级
+func (s *scheduler) sortMetas(metas []Meta, priorities map[string]int) {
+	s.lock.Lock()
+	order := s.order
+	diskFree := s.diskFree
+	s.lock.Unlock()
+
+	// 目录的年龄取其中最早入库的文件
+	ages := map[string]int64{}
+	frees := map[string]float64{}
+	for _, m := range metas {
+		dir := m.Dir()
+		if age, ok := ages[dir]; !ok || (m.CreatedAt > 0 && m.CreatedAt < age) {
+			ages[dir] = m.CreatedAt
+		}
+		if _, ok := frees[dir]; ok {
+			continue
+		}
+		frees[dir] = 100
+		if diskFree == nil {
+			continue
+		}
+		if free, ok := diskFree(dir); ok {
+			frees[dir] = free
+		}
+	}
+
+	sort.SliceStable(metas, func(i, j int) bool {
+		di, dj := metas[i].Dir(), metas[j].Dir()
+		for _, o := range order {
+			switch o {
+			case OrderPriority:
+				if priorities[di] != priorities[dj] {
+					return priorities[di] > priorities[dj]
+				}
+			case OrderDiskFree:
+				if frees[di] != frees[dj] {
+					return frees[di] < frees[dj]
+				}
+			case OrderAge:
+				if ages[di] != ages[dj] {
+					return ages[di] < ages[dj]
+				}
+			case OrderSize:
+				if metas[i].Size != metas[j].Size {
+					return metas[i].Size > metas[j].Size
+				}
+			}
+		}
+		return false
+	})
+}
+
+// SetPriority 设置目录的优先级, 为 0 时删除
+func SetPriority(dir string, priority int) error {
+	dir = filepath.Clean(dir)
+	return db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(db.PriorityBucket)
+		if priority == 0 {
+			return bk.Delete([]byte(dir))
+		}
+		b, err := json.Marshal(priority)
+		if err != nil {
+			return err
+		}
+		return bk.Put([]byte(dir), b)
+	})
+}
+
+// Priorities 返回所有目录的优先级
+func Priorities() (map[string]int, error) {
+	priorities := map[string]int{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return loadPriorities(tx, priorities)
+	})
+	return priorities, err
+}
+
+func loadPriorities(tx *bolt.Tx, priorities map[string]int) error {
+	return tx.Bucket(db.PriorityBucket).ForEach(func(k, v []byte) error {
+		priority := 0
+		if err := json.Unmarshal(v, &priority); err != nil {
+			log.Errorf(log.Fields{}, "invalid priority of %v: %v", string(k), err)
+			return nil
+		}
+		priorities[string(k)] = priority
+		return nil
+	})
+}
@@ -0,0 +1,91 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+)
+
+var (
+	// ErrIllegalTransition 状态机不允许的变更
+	ErrIllegalTransition = errors.New("illegal task status transition")
+	// ErrStatusConflict 当前状态与期望的不一致, 已被其他请求修改
+	ErrStatusConflict = errors.New("task status changed concurrently")
+)
+
+var transitionRejected = metrics.NewCounter("spacemesh_proxy_task_transition_rejected_total", "Rejected task status transitions", "from", "to", "reason")
+
+var statusNames = map[uint8]string{
+	TaskErr:    "error",
+	TaskTodo:   "todo",
+	TaskWait:   "wait",
+	TaskFinish: "finish",
+	TaskDone:   "done",
+}
+
+// transitions 允许的状态变更
+//
+//	todo   -> wait     通知存储节点成功
+//	todo   -> finish   存储节点在 Upload 更新状态之前已完成
+//	wait   -> finish   存储节点完成
+//	wait   -> todo     存储节点失败, 重新传输
+//	finish -> done     本地文件已处理
+//	done   -> todo     已传输的文件被改写, 重新传输
+//	error  -> todo     重试
+var transitions = map[uint8][]uint8{
+	TaskTodo:   {TaskWait, TaskFinish, TaskErr},
+	TaskWait:   {TaskFinish, TaskTodo, TaskErr},
+	TaskFinish: {TaskDone, TaskErr},
+	TaskErr:    {TaskTodo},
+	TaskDone:   {TaskTodo},
+}
+
+// StatusName 返回状态的名称
+func StatusName(status uint8) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%v)", status)
+}
+
+// Statuses 返回所有状态
+func Statuses() []uint8 {
+	return []uint8{TaskErr, TaskTodo, TaskWait, TaskFinish, TaskDone}
+}
+
+// ParseStatus 按名称返回状态
+func ParseStatus(name string) (uint8, bool) {
+	for status, _name := range statusNames {
+		if _name == name {
+			return status, true
+		}
+	}
+	return 0, false
+}
+
+// CanTransition 状态机是否允许从 from 变更到 to
+func CanTransition(from, to uint8) bool {
+	return containsStatus(transitions[from], to)
+}
+
+// checkTransition 在存储的事务中校验状态变更, 当前状态需在 expect 中, expect 为空时不比较
+func checkTransition(path string, cur, to uint8, expect []uint8) error {
+	var err error
+	reason := ""
+	switch {
+	case len(expect) > 0 && !containsStatus(expect, cur):
+		err = ErrStatusConflict
+		reason = "conflict"
+	case !CanTransition(cur, to):
+		err = ErrIllegalTransition
+		reason = "illegal"
+	default:
+		return nil
+	}
+
+	log.Errorf(log.Fields{}, "reject %v transition %v -> %v: %v", path, StatusName(cur), StatusName(to), err)
+	transitionRejected.Inc(StatusName(cur), StatusName(to), reason)
+	return fmt.Errorf("%v %v -> %v: %w", path, StatusName(cur), StatusName(to), err)
+}
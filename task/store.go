@@ -0,0 +1,139 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	StoreBolt   = "bolt"
+	StoreSQLite = "sqlite"
+
+	DefaultStore = StoreBolt
+)
+
+var (
+	ErrTaskNotFound  = errors.New("task not found")
+	ErrTaskExists    = errors.New("task already exists")
+	ErrStatusChanged = errors.New("task status must be changed by Transition")
+)
+
+// TaskStore 文件传输任务的存储, 任务以本地文件路径为键
+type TaskStore interface {
+	Get(path string) (Meta, error)
+	// Add 添加新的任务, 已存在时返回 ErrTaskExists
+	Add(meta Meta) error
+	// Put 添加或覆盖任务
+	Put(meta Meta) error
+	Delete(path string) error
+	// Update 在一个事务中读取并修改任务, 状态只能通过 Transition 修改
+	Update(path string, fn func(meta *Meta) error) (Meta, error)
+	// Transition 在当前状态属于 from 时修改任务状态, by 为发起者, 返回提交的变更
+	// from 为空时不比较当前状态, 变更仍需满足状态机, 否则返回 ErrIllegalTransition
+	// 与事件记录在同一个数据库中的实现在同一个事务中写入事件记录并设置 Seq
+	// 需要通知订阅者时使用包级的 Transition
+	Transition(path string, by Trigger, to uint8, from ...uint8) (TransitionEvent, error)
+	// TransitionUpdate 同 Transition, 校验通过后在同一个事务中以 fn 修改任务, fn 返回错误时不提交
+	// fn 看到的是变更前的状态, 不能修改状态, fn 为 nil 时同 Transition
+	TransitionUpdate(path string, by Trigger, to uint8, fn func(meta *Meta) error, from ...uint8) (TransitionEvent, error)
+	// 以下按索引查询, 结果按路径排序
+	ListByStatus(status ...uint8) ([]Meta, error)
+	ListByHost(host string) ([]Meta, error)
+	// ListByDir 不包含子目录
+	ListByDir(dir string) ([]Meta, error)
+	Close() error
+}
+
+// StoreOpener 按路径打开存储, 路径的含义由实现决定
+type StoreOpener func(path string) (TaskStore, error)
+
+var (
+	stores     = map[string]StoreOpener{}
+	storesLock sync.Mutex
+
+	// 未调用 OpenStore 时使用 bolt
+	globalStore TaskStore = &boltStore{}
+)
+
+// RegisterStore 注册存储实现, 可选的实现在编译标签打开时注册
+func RegisterStore(name string, opener StoreOpener) {
+	storesLock.Lock()
+	stores[name] = opener
+	storesLock.Unlock()
+}
+
+// HasStore 存储实现是否已编译
+func HasStore(name string) bool {
+	storesLock.Lock()
+	_, ok := stores[name]
+	storesLock.Unlock()
+	return ok
+}
+
+// StoreNames 已编译的存储实现
+func StoreNames() []string {
+	storesLock.Lock()
+	names := []string{}
+	for name := range stores {
+		names = append(names, name)
+	}
+	storesLock.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// OpenStore 打开全局使用的存储, 需要在 NewQueue 之前调用
+func OpenStore(name, path string) error {
+	if name == "" {
+		name = DefaultStore
+	}
+	storesLock.Lock()
+	opener, ok := stores[name]
+	storesLock.Unlock()
+	if !ok {
+		return fmt.Errorf("task store %v not supported, available %v", name, StoreNames())
+	}
+
+	s, err := opener(path)
+	if err != nil {
+		return err
+	}
+	globalStore = s
+	return nil
+}
+
+// Store 返回全局使用的存储
+func Store() TaskStore {
+	return globalStore
+}
+
+// CloseStore 关闭全局使用的存储
+func CloseStore() error {
+	if globalStore == nil {
+		return nil
+	}
+	return globalStore.Close()
+}
+
+// updateMeta 执行 Update 的修改, 校验状态未变
+func updateMeta(meta *Meta, fn func(meta *Meta) error) error {
+	status, path := meta.Status, meta.Path
+	if err := fn(meta); err != nil {
+		return err
+	}
+	if meta.Status != status || meta.Path != path {
+		return ErrStatusChanged
+	}
+	return nil
+}
+
+func containsStatus(status []uint8, s uint8) bool {
+	for _, _s := range status {
+		if _s == s {
+			return true
+		}
+	}
+	return false
+}
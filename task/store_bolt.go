@@ -0,0 +1,198 @@
+package task
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
+	"github.com/boltdb/bolt"
+)
+
+func init() {
+	RegisterStore(StoreBolt, func(path string) (TaskStore, error) {
+		return &boltStore{}, nil
+	})
+}
+
+// boltStore 任务保存在 db.TaskBucket 中, 索引与任务在同一个事务中更新
+// 数据库由 db 包打开和关闭
+type boltStore struct{}
+
+func (s *boltStore) view(fn func(tx *bolt.Tx) error) error {
+	return db.View(fn)
+}
+
+func (s *boltStore) update(fn func(tx *bolt.Tx) error) error {
+	return db.Update(fn)
+}
+
+func getMeta(tx *bolt.Tx, path string) (Meta, error) {
+	meta := Meta{}
+	r := tx.Bucket(db.TaskBucket).Get([]byte(path))
+	if r == nil {
+		return meta, ErrTaskNotFound
+	}
+	err := json.Unmarshal(r, &meta)
+	return meta, err
+}
+
+// putMeta 写入任务并替换原有的索引
+func putMeta(tx *bolt.Tx, meta Meta) error {
+	if err := deleteMeta(tx, meta.Path); err != nil {
+		return err
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(db.TaskBucket).Put([]byte(meta.Path), b); err != nil {
+		return err
+	}
+	return db.PutTaskIndex(tx, meta.Path, meta.Status, meta.Host)
+}
+
+func deleteMeta(tx *bolt.Tx, path string) error {
+	old, err := getMeta(tx, path)
+	if err == ErrTaskNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := db.DeleteTaskIndex(tx, path, old.Status, old.Host); err != nil {
+		return err
+	}
+	return tx.Bucket(db.TaskBucket).Delete([]byte(path))
+}
+
+func (s *boltStore) Get(path string) (Meta, error) {
+	meta := Meta{}
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = getMeta(tx, path)
+		return err
+	})
+	return meta, err
+}
+
+func (s *boltStore) Add(meta Meta) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if tx.Bucket(db.TaskBucket).Get([]byte(meta.Path)) != nil {
+			return ErrTaskExists
+		}
+		return putMeta(tx, meta)
+	})
+}
+
+func (s *boltStore) Put(meta Meta) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return putMeta(tx, meta)
+	})
+}
+
+func (s *boltStore) Delete(path string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return deleteMeta(tx, path)
+	})
+}
+
+func (s *boltStore) Update(path string, fn func(meta *Meta) error) (Meta, error) {
+	meta := Meta{}
+	err := s.update(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = getMeta(tx, path)
+		if err != nil {
+			return err
+		}
+		if err := updateMeta(&meta, fn); err != nil {
+			return err
+		}
+		return putMeta(tx, meta)
+	})
+	return meta, err
+}
+
+func (s *boltStore) Transition(path string, by Trigger, to uint8, from ...uint8) (TransitionEvent, error) {
+	return s.TransitionUpdate(path, by, to, nil, from...)
+}
+
+func (s *boltStore) TransitionUpdate(path string, by Trigger, to uint8, fn func(meta *Meta) error, from ...uint8) (TransitionEvent, error) {
+	ev := TransitionEvent{}
+	err := s.update(func(tx *bolt.Tx) error {
+		meta, err := getMeta(tx, path)
+		if err != nil {
+			return err
+		}
+		if err := checkTransition(path, meta.Status, to, from); err != nil {
+			return err
+		}
+		if fn != nil {
+			if err := updateMeta(&meta, fn); err != nil {
+				return err
+			}
+		}
+		prev := meta.Status
+		meta.Status = to
+		meta.UpdatedAt = time.Now().Unix()
+		if err := putMeta(tx, meta); err != nil {
+			return err
+		}
+		// 事件记录与状态在同一个事务中提交, 崩溃后不会缺失
+		ev = newTransition(meta, prev, by)
+		b, err := json.Marshal(ev.event())
+		if err != nil {
+			return err
+		}
+		ev.Seq, err = db.AppendEvent(tx, b, ev.Path, meta.Dir())
+		return err
+	})
+	if err != nil {
+		return TransitionEvent{}, err
+	}
+	return ev, nil
+}
+
+// list 按索引取出任务, 索引与任务不一致时跳过
+func (s *boltStore) list(scan func(tx *bolt.Tx, fn func(path string) error) error) ([]Meta, error) {
+	metas := []Meta{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return scan(tx, func(path string) error {
+			meta, err := getMeta(tx, path)
+			if err != nil {
+				log.Errorf(log.Fields{}, "invalid indexed task %v: %v", path, err)
+				return nil
+			}
+			metas = append(metas, meta)
+			return nil
+		})
+	})
+	return metas, err
+}
+
+func (s *boltStore) ListByStatus(status ...uint8) ([]Meta, error) {
+	return s.list(func(tx *bolt.Tx, fn func(path string) error) error {
+		for _, _s := range status {
+			if err := db.ScanTaskStatus(tx, _s, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) ListByHost(host string) ([]Meta, error) {
+	return s.list(func(tx *bolt.Tx, fn func(path string) error) error {
+		return db.ScanTaskHost(tx, host, fn)
+	})
+}
+
+func (s *boltStore) ListByDir(dir string) ([]Meta, error) {
+	return s.list(func(tx *bolt.Tx, fn func(path string) error) error {
+		return db.ScanTaskDir(tx, dir, fn)
+	})
+}
+
+func (s *boltStore) Close() error {
+	return nil
+}
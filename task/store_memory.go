@@ -0,0 +1,178 @@
+package task
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryIndex map[string]map[string]struct{}
+
+func (idx memoryIndex) put(value, path string) {
+	paths, ok := idx[value]
+	if !ok {
+		paths = make(map[string]struct{})
+		idx[value] = paths
+	}
+	paths[path] = struct{}{}
+}
+
+func (idx memoryIndex) delete(value, path string) {
+	paths, ok := idx[value]
+	if !ok {
+		return
+	}
+	delete(paths, path)
+	if len(paths) == 0 {
+		delete(idx, value)
+	}
+}
+
+// memoryStore 不持久化, 只用于测试, 不能通过 task_store 选择
+type memoryStore struct {
+	metas    map[string]Meta
+	byStatus memoryIndex
+	byHost   memoryIndex
+	byDir    memoryIndex
+	lock     sync.RWMutex
+}
+
+func NewMemoryStore() TaskStore {
+	return &memoryStore{
+		metas:    make(map[string]Meta),
+		byStatus: make(memoryIndex),
+		byHost:   make(memoryIndex),
+		byDir:    make(memoryIndex),
+	}
+}
+
+func (s *memoryStore) put(meta Meta) {
+	s.delete(meta.Path)
+	s.metas[meta.Path] = meta
+	s.byStatus.put(StatusName(meta.Status), meta.Path)
+	s.byHost.put(meta.Host, meta.Path)
+	s.byDir.put(meta.Dir(), meta.Path)
+}
+
+func (s *memoryStore) delete(path string) {
+	old, ok := s.metas[path]
+	if !ok {
+		return
+	}
+	delete(s.metas, path)
+	s.byStatus.delete(StatusName(old.Status), path)
+	s.byHost.delete(old.Host, path)
+	s.byDir.delete(old.Dir(), path)
+}
+
+func (s *memoryStore) Get(path string) (Meta, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	meta, ok := s.metas[path]
+	if !ok {
+		return Meta{}, ErrTaskNotFound
+	}
+	return meta, nil
+}
+
+func (s *memoryStore) Add(meta Meta) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.metas[meta.Path]; ok {
+		return ErrTaskExists
+	}
+	s.put(meta)
+	return nil
+}
+
+func (s *memoryStore) Put(meta Meta) error {
+	s.lock.Lock()
+	s.put(meta)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Delete(path string) error {
+	s.lock.Lock()
+	s.delete(path)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Update(path string, fn func(meta *Meta) error) (Meta, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	meta, ok := s.metas[path]
+	if !ok {
+		return Meta{}, ErrTaskNotFound
+	}
+	if err := updateMeta(&meta, fn); err != nil {
+		return s.metas[path], err
+	}
+	s.put(meta)
+	return meta, nil
+}
+
+func (s *memoryStore) Transition(path string, by Trigger, to uint8, from ...uint8) (TransitionEvent, error) {
+	return s.TransitionUpdate(path, by, to, nil, from...)
+}
+
+func (s *memoryStore) TransitionUpdate(path string, by Trigger, to uint8, fn func(meta *Meta) error, from ...uint8) (TransitionEvent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	meta, ok := s.metas[path]
+	if !ok {
+		return TransitionEvent{}, ErrTaskNotFound
+	}
+	prev := meta.Status
+	if err := checkTransition(path, meta.Status, to, from); err != nil {
+		return TransitionEvent{}, err
+	}
+	if fn != nil {
+		if err := updateMeta(&meta, fn); err != nil {
+			return TransitionEvent{}, err
+		}
+	}
+	meta.Status = to
+	meta.UpdatedAt = time.Now().Unix()
+	s.put(meta)
+	return newTransition(meta, prev, by), nil
+}
+
+// list 按路径排序, 与 bolt 的遍历顺序一致
+func (s *memoryStore) list(idx memoryIndex, values ...string) ([]Meta, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	metas := []Meta{}
+	for _, value := range values {
+		_metas := []Meta{}
+		for path := range idx[value] {
+			_metas = append(_metas, s.metas[path])
+		}
+		sort.Slice(_metas, func(i, j int) bool {
+			return _metas[i].Path < _metas[j].Path
+		})
+		metas = append(metas, _metas...)
+	}
+	return metas, nil
+}
+
+func (s *memoryStore) ListByStatus(status ...uint8) ([]Meta, error) {
+	names := []string{}
+	for _, _s := range status {
+		names = append(names, StatusName(_s))
+	}
+	return s.list(s.byStatus, names...)
+}
+
+func (s *memoryStore) ListByHost(host string) ([]Meta, error) {
+	return s.list(s.byHost, host)
+}
+
+func (s *memoryStore) ListByDir(dir string) ([]Meta, error) {
+	return s.list(s.byDir, dir)
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,268 @@
+//go:build sqlite
+// +build sqlite
+
+package task
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	RegisterStore(StoreSQLite, openSQLiteStore)
+}
+
+// sqliteMigrations 按 PRAGMA user_version 依次执行
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS tasks (
+		path   TEXT PRIMARY KEY,
+		status INTEGER NOT NULL,
+		host   TEXT NOT NULL,
+		meta   TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS tasks_status ON tasks (status);
+	CREATE INDEX IF NOT EXISTS tasks_host ON tasks (host);`,
+	// 按目录查询, 已有的任务在打开时补全
+	`ALTER TABLE tasks ADD COLUMN dir TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS tasks_dir ON tasks (dir);`,
+}
+
+// sqliteStore 使用 -tags sqlite 编译时可用, 需要 cgo
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (TaskStore, error) {
+	sdb, err := sql.Open("sqlite3", path+"?_busy_timeout=10000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite 同时只允许一个写入
+	sdb.SetMaxOpenConns(1)
+	if err := migrateSQLite(sdb); err != nil {
+		sdb.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: sdb}, nil
+}
+
+func migrateSQLite(sdb *sql.DB) error {
+	version := 0
+	if err := sdb.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("sqlite schema version %v is newer than supported %v", version, len(sqliteMigrations))
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := sdb.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("fail to migrate sqlite to version %v: %v", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return backfillSQLiteDir(sdb)
+}
+
+// backfillSQLiteDir 补全添加 dir 列之前的任务
+func backfillSQLiteDir(sdb *sql.DB) error {
+	rows, err := sdb.Query("SELECT path FROM tasks WHERE dir = ''")
+	if err != nil {
+		return err
+	}
+	paths := []string{}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if _, err := sdb.Exec("UPDATE tasks SET dir = ? WHERE path = ?", filepath.Dir(path), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sqlQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func sqliteGet(q sqlQuerier, path string) (Meta, error) {
+	meta := Meta{}
+	var b string
+	err := q.QueryRow("SELECT meta FROM tasks WHERE path = ?", path).Scan(&b)
+	if err == sql.ErrNoRows {
+		return meta, ErrTaskNotFound
+	}
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal([]byte(b), &meta)
+	return meta, err
+}
+
+func sqlitePut(q sqlQuerier, meta Meta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("INSERT OR REPLACE INTO tasks (path, status, host, dir, meta) VALUES (?, ?, ?, ?, ?)",
+		meta.Path, meta.Status, meta.Host, meta.Dir(), string(b))
+	return err
+}
+
+func (s *sqliteStore) Get(path string) (Meta, error) {
+	return sqliteGet(s.db, path)
+}
+
+func (s *sqliteStore) Add(meta Meta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	r, err := s.db.Exec("INSERT OR IGNORE INTO tasks (path, status, host, dir, meta) VALUES (?, ?, ?, ?, ?)",
+		meta.Path, meta.Status, meta.Host, meta.Dir(), string(b))
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err == nil && n == 0 {
+		return ErrTaskExists
+	}
+	return nil
+}
+
+func (s *sqliteStore) Put(meta Meta) error {
+	return sqlitePut(s.db, meta)
+}
+
+func (s *sqliteStore) Delete(path string) error {
+	_, err := s.db.Exec("DELETE FROM tasks WHERE path = ?", path)
+	return err
+}
+
+func (s *sqliteStore) Update(path string, fn func(meta *Meta) error) (Meta, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Meta{}, err
+	}
+	defer tx.Rollback()
+
+	meta, err := sqliteGet(tx, path)
+	if err != nil {
+		return meta, err
+	}
+	if err := updateMeta(&meta, fn); err != nil {
+		return meta, err
+	}
+	if err := sqlitePut(tx, meta); err != nil {
+		return meta, err
+	}
+	return meta, tx.Commit()
+}
+
+func (s *sqliteStore) Transition(path string, by Trigger, to uint8, from ...uint8) (TransitionEvent, error) {
+	return s.TransitionUpdate(path, by, to, nil, from...)
+}
+
+func (s *sqliteStore) TransitionUpdate(path string, by Trigger, to uint8, fn func(meta *Meta) error, from ...uint8) (TransitionEvent, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return TransitionEvent{}, err
+	}
+	defer tx.Rollback()
+
+	meta, err := sqliteGet(tx, path)
+	if err != nil {
+		return TransitionEvent{}, err
+	}
+	prev := meta.Status
+	if err := checkTransition(path, meta.Status, to, from); err != nil {
+		return TransitionEvent{}, err
+	}
+	if fn != nil {
+		if err := updateMeta(&meta, fn); err != nil {
+			return TransitionEvent{}, err
+		}
+	}
+	meta.Status = to
+	meta.UpdatedAt = time.Now().Unix()
+	if err := sqlitePut(tx, meta); err != nil {
+		return TransitionEvent{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return TransitionEvent{}, err
+	}
+	return newTransition(meta, prev, by), nil
+}
+
+func (s *sqliteStore) list(query string, args ...interface{}) ([]Meta, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metas := []Meta{}
+	for rows.Next() {
+		var b string
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		meta := Meta{}
+		if err := json.Unmarshal([]byte(b), &meta); err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	return metas, rows.Err()
+}
+
+func (s *sqliteStore) ListByStatus(status ...uint8) ([]Meta, error) {
+	metas := []Meta{}
+	for _, _s := range status {
+		_metas, err := s.list("SELECT meta FROM tasks WHERE status = ? ORDER BY path", _s)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, _metas...)
+	}
+	return metas, nil
+}
+
+func (s *sqliteStore) ListByHost(host string) ([]Meta, error) {
+	return s.list("SELECT meta FROM tasks WHERE host = ? ORDER BY path", host)
+}
+
+func (s *sqliteStore) ListByDir(dir string) ([]Meta, error) {
+	return s.list("SELECT meta FROM tasks WHERE dir = ? ORDER BY path", dir)
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
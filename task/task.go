@@ -1,95 +1,81 @@
 package task
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"os"
 	"path/filepath"
-	"strings"
 
 	log "github.com/EntropyPool/entropy-logger"
-	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/db"
-	"github.com/NpoolSpacemesh/spacemesh-storage-server/api"
 	apitypes "github.com/NpoolSpacemesh/spacemesh-storage-server/types"
-	"github.com/boltdb/bolt"
 )
 
 const PlotFilePrefix = "/plotfile"
 const PlotFileHandle = PlotFilePrefix + "/"
 
-func Upload(input Meta) {
-	log.Infof(log.Fields{}, "try to serve file %v -> %v", input.PlotURL, input.Host)
-	_, err := api.UploadPlot(input.Host, "18080", apitypes.UploadPlotInput{
-		PlotURL:   input.PlotURL,
-		FinishURL: input.FinishURL,
-		FailURL:   input.FailURL,
+func Upload(ctx context.Context, input Meta) {
+	// 按当前配置生成地址, 入库后 host 或端口可能已经变更
+	plotURL := PlotURL(input.LocalPath())
+	log.Infof(log.Fields{}, "try to serve file %v -> %v", plotURL, input.Host)
+	err := UploadPlot(ctx, input.Host, apitypes.UploadPlotInput{
+		PlotURL:   plotURL,
+		FinishURL: FinishURL(),
+		FailURL:   FailURL(),
 		DiskSpace: input.DiskSpace,
 	})
+	reason := ""
 	if err != nil {
-		log.Errorf(log.Fields{}, "fail to notify new plot -> %v", input.Host)
+		reason = FailReason(err)
+	}
+	// 取消不是存储节点的问题
+	if reason != FailCancelled {
+		recordHost(input.Host, err)
+	}
+	if err != nil {
+		log.Errorf(log.Fields{}, "fail to notify new plot -> %v (%v): %v", input.Host, reason, err)
+		by := Trigger{Actor: ActorQueue, Remote: input.Host}
+		if err := retry(input.LocalPath(), by, TaskTodo, reason, err); err != nil {
+			log.Errorf(log.Fields{}, "fail to schedule retry of %v: %v", input.LocalPath(), err)
+		}
 		return
 	}
 
 	// 更新数据库
-	update(input.PlotURL, TaskWait)
+	update(input.LocalPath(), Trigger{Actor: ActorQueue, Remote: input.Host}, TaskWait, TaskTodo)
 }
 
-func Finsih(input Meta) {
+func Finsih(ctx context.Context, input Meta) {
 	// 移除本地的 plot 文件
-	files := strings.Split(input.PlotURL, PlotFilePrefix)
-	if len(files) < 2 {
+	file := input.LocalPath()
+	if file == "" {
 		log.Errorf(log.Fields{}, "invalid file description: %v", input.PlotURL)
 		return
 	}
-	log.Infof(log.Fields{}, "remove finish plot file %v", files[1])
-	_, err := os.Stat(filepath.Dir(files[1]))
+	log.Infof(log.Fields{}, "remove finish plot file %v", file)
+	_, err := os.Stat(filepath.Dir(file))
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			// 已经移除
-			update(input.PlotURL, TaskDone)
+			update(file, Trigger{Actor: ActorQueue}, TaskDone, TaskFinish)
 			return
 		}
-		log.Errorf(log.Fields{}, "remove finish plot file %v, error %v", files[1], err)
+		log.Errorf(log.Fields{}, "remove finish plot file %v, error %v", file, err)
 		return
 	}
 
-	// os.RemoveAll(files[1])
+	// os.RemoveAll(file)
 	// 更新数据库
-	update(input.PlotURL, TaskDone)
+	update(file, Trigger{Actor: ActorQueue}, TaskDone, TaskFinish)
 }
 
-func Fail(input Meta) {
+func Fail(ctx context.Context, input Meta) {
 }
 
-func update(key string, status uint8) error {
-	bdb, err := db.BoltClient()
-	if err != nil {
-		return err
+// update 当前状态属于 from 且仍持有租约时更新, 期间被回调修改过或被其他 worker 取得的任务不会被覆盖
+func update(key string, by Trigger, to uint8, from ...uint8) error {
+	_, err := TransitionUpdate(key, by, to, checkLease, from...)
+	if errors.Is(err, ErrLeaseHeld) {
+		log.Errorf(log.Fields{}, "skip %v -> %v: %v", key, StatusName(to), err)
 	}
-
-	return bdb.Update(func(tx *bolt.Tx) error {
-		bk := tx.Bucket(db.DefaultBucket)
-		r := bk.Get([]byte(key))
-		if r == nil {
-			return errors.New("bolt key not exist")
-		}
-
-		// 删除原有的 key
-		if err := bk.Delete([]byte(key)); err != nil {
-			return err
-		}
-
-		meta := Meta{}
-		if err := json.Unmarshal(r, &meta); err != nil {
-			return err
-		}
-		meta.Status = status
-		_meta, err := json.Marshal(meta)
-		if err != nil {
-			return err
-		}
-
-		// 插入最新的 key
-		return bk.Put([]byte(key), _meta)
-	})
+	return err
 }
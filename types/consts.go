@@ -2,6 +2,34 @@ package types
 
 const (
 	NewPlotAPI    = "/api/v0/plot/new"
+	PlotJobAPI    = "/api/v0/plot/job"
 	FinishPlotAPI = "/api/v0/plot/finish"
 	FailPlotAPI   = "/api/v0/plot/fail"
+
+	ConfigStatusAPI = "/api/v0/config/status"
+
+	ListQuarantineAPI  = "/api/v0/quarantine/list"
+	ClearQuarantineAPI = "/api/v0/quarantine/clear"
+
+	PlotPathHealthAPI = "/api/v0/path/health"
+	DiskStatusAPI     = "/api/v0/disk/status"
+
+	SetPriorityAPI  = "/api/v0/priority/set"
+	ListPriorityAPI = "/api/v0/priority/list"
+
+	ListHostAPI    = "/api/v0/host/list"
+	ListTaskAPI    = "/api/v0/task/list"
+	ListHistoryAPI = "/api/v0/task/history"
+	ExportAPI      = "/api/v0/task/export"
+	CancelTaskAPI  = "/api/v0/task/cancel"
+	RequeueTaskAPI = "/api/v0/task/requeue"
+	ProgressAPI    = "/api/v0/task/progress"
+
+	BackupAPI     = "/api/v0/db/backup"
+	SaveBackupAPI = "/api/v0/db/backup/save"
+
+	ListPlacementAPI = "/api/v0/placement/list"
+
+	ListEventAPI   = "/api/v0/event/list"
+	EventStreamAPI = "/api/v0/event/stream"
 )
@@ -1,11 +1,177 @@
 package types
 
+import "github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
+
 type NewPlotInput struct {
 	PlotDir string `json:"dir"`
+	// 可选, 任务结束时 POST 任务状态到该地址
+	NotifyURL string `json:"notify_url"`
+}
+
+type NewPlotOutput struct {
+	JobID string `json:"job_id"`
 }
 
 type FinishPlotInput struct {
 	PlotFile string `json:"file"`
+	// 可选, 存储节点上的存放路径及文件校验和, 记录到 placement
+	RemotePath string `json:"remote_path,omitempty"`
+	Checksum   string `json:"checksum,omitempty"`
 }
 
 type FailPlotInput = FinishPlotInput
+
+type QuarantinedDir struct {
+	Dir         string `json:"dir"`
+	LastError   string `json:"last_error"`
+	Count       int    `json:"count"`
+	LastFailAt  int64  `json:"last_fail_at"`
+	NextRetryAt int64  `json:"next_retry_at"`
+}
+
+type ListQuarantineOutput struct {
+	Dirs []QuarantinedDir `json:"dirs"`
+}
+
+type ClearQuarantineInput struct {
+	Dirs []string `json:"dirs"`
+	// 清除全部, 此时忽略 dirs
+	All bool `json:"all"`
+}
+
+type PlotPathHealth struct {
+	Path    string `json:"path"`
+	Healthy bool   `json:"healthy"`
+	Running bool   `json:"running"`
+	Error   string `json:"error"`
+	// 最近一次索引开始时间及耗时(秒)
+	LastIndexAt   int64 `json:"last_index_at"`
+	LastIndexCost int64 `json:"last_index_cost"`
+}
+
+type PlotPathHealthOutput struct {
+	Paths []PlotPathHealth `json:"paths"`
+}
+
+type DiskStatus struct {
+	Path        string  `json:"path"`
+	Exists      bool    `json:"exists"`
+	MountPoint  string  `json:"mount_point"`
+	Mounted     bool    `json:"mounted"`
+	ReadOnly    bool    `json:"read_only"`
+	TotalBytes  uint64  `json:"total_bytes"`
+	FreeBytes   uint64  `json:"free_bytes"`
+	FreePercent float64 `json:"free_percent"`
+	TotalInodes uint64  `json:"total_inodes"`
+	FreeInodes  uint64  `json:"free_inodes"`
+	Healthy     bool    `json:"healthy"`
+	// 剩余空间低于 disk_pause_percent 时不再接受新的 plot
+	Accepting bool `json:"accepting"`
+	// 剩余空间低于 disk_drain_percent 时优先传输
+	Draining  bool   `json:"draining"`
+	Error     string `json:"error"`
+	CheckedAt int64  `json:"checked_at"`
+}
+
+type DiskStatusOutput struct {
+	Disks []DiskStatus `json:"disks"`
+}
+
+type CancelTaskInput struct {
+	Path string `json:"path"`
+}
+
+type RequeueTaskInput struct {
+	Path string `json:"path"`
+}
+
+type SetPriorityInput struct {
+	Dir      string `json:"dir"`
+	Priority int    `json:"priority"`
+}
+
+type ListPriorityOutput struct {
+	Dirs []SetPriorityInput `json:"dirs"`
+}
+
+type ReloadStatus struct {
+	ConfigFile string `json:"config_file"`
+	// 当前生效配置文件的 md5
+	Checksum      string `json:"checksum"`
+	LastReloadAt  int64  `json:"last_reload_at"`
+	LastAttemptAt int64  `json:"last_attempt_at"`
+	LastError     string `json:"last_error"`
+	// 校验失败的配置文件 md5, 未变更前不再重复加载
+	FailedChecksum string `json:"failed_checksum"`
+}
+
+type PlacementFile struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+	// 完成传输的存储节点及其下载的地址, 重试时可能换到其他存储节点
+	Host    string `json:"host"`
+	PlotURL string `json:"plot_url"`
+	// 存储节点上报的存放路径及校验和
+	RemotePath     string `json:"remote_path"`
+	RemoteChecksum string `json:"remote_checksum"`
+	// 本地计算的 sha256, placement_checksum 打开时记录
+	Checksum   string `json:"checksum"`
+	FinishedAt int64  `json:"finished_at"`
+}
+
+// Placement 一个 PoST 目录传输到的位置, 本地目录清理后保留
+type Placement struct {
+	NodeID          string `json:"node_id"`
+	CommitmentAtxID string `json:"commitment_atx_id"`
+	NumUnits        int    `json:"num_units"`
+	// 目录中的文件所在的存储节点
+	Hosts []string `json:"hosts"`
+	// 所有文件在存储节点的同一个目录时记录该目录
+	RemotePath    string          `json:"remote_path"`
+	LocalPath     string          `json:"local_path"`
+	Files         []PlacementFile `json:"files"`
+	TransferredAt int64           `json:"transferred_at"`
+}
+
+type ListPlacementOutput struct {
+	Placements []Placement `json:"placements"`
+}
+
+// TaskProgress 一个文件的发送进度, 速度单位字节每秒
+type TaskProgress struct {
+	Size       uint64  `json:"size"`
+	Served     uint64  `json:"served"`
+	Throughput float64 `json:"throughput"`
+	// 是否仍有请求在发送
+	Active bool `json:"active"`
+}
+
+// DirProgress 目录中未完成的文件的传输进度, ETA 单位秒, 无法估计时为 -1
+type DirProgress struct {
+	Dir          string  `json:"dir"`
+	Files        int     `json:"files"`
+	Transferring int     `json:"transferring"`
+	Size         uint64  `json:"size"`
+	Served       uint64  `json:"served"`
+	Throughput   float64 `json:"throughput"`
+	ETA          int64   `json:"eta"`
+}
+
+// EventRecord 事件记录, Seq 为追加的序号
+type EventRecord struct {
+	Seq   uint64      `json:"seq"`
+	Event event.Event `json:"event"`
+}
+
+type ListEventOutput struct {
+	Events []EventRecord `json:"events"`
+}
+
+type ListProgressOutput struct {
+	Dirs []DirProgress `json:"dirs"`
+}
+
+// SaveBackupOutput 保存到 backup_dir 的备份文件
+type SaveBackupOutput struct {
+	Path string `json:"path"`
+}
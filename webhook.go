@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/EntropyPool/entropy-logger"
+	httpdaemon "github.com/NpoolRD/http-daemon"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/event"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/metrics"
+	"github.com/NpoolSpacemesh/spacemesh-storage-proxy/task"
+)
+
+const (
+	DefaultWebhookRetries = 3
+
+	// 每个地址等待投递的事件数, 超过后丢弃
+	webhookQueueSize    = 1024
+	webhookBackoffBase  = time.Second
+	webhookSignatureKey = "X-Spacemesh-Signature"
+)
+
+var webhookDeliveries = metrics.NewCounter("spacemesh_proxy_webhook_deliveries_total", "Webhook deliveries", "result")
+
+// WebhookConfig 事件以 JSON POST 到 url, 配置了 secret 时以 HMAC-SHA256 签名
+type WebhookConfig struct {
+	URL    string `json:"url" yaml:"url" toml:"url"`
+	Secret string `json:"secret" yaml:"secret" toml:"secret"`
+	// 只投递这些类型的事件, 支持 "task.*" 前缀, 为空时投递所有事件
+	Events []string `json:"events" yaml:"events" toml:"events"`
+	// 失败后的重试次数, 退避时间每次翻倍, 未配置时为 DefaultWebhookRetries, 0 不重试
+	Retries *int `json:"retries" yaml:"retries" toml:"retries"`
+}
+
+// webhookQueues 每个地址一个队列及投递协程, 慢的地址不阻塞其他地址
+type webhookQueues struct {
+	queues map[string]chan event.Event
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	lock   sync.Mutex
+}
+
+func newWebhookQueues() *webhookQueues {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookQueues{
+		queues: map[string]chan event.Event{},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// push 放入 url 的队列, 第一次使用时启动 worker, 队列满或已关闭时返回 false
+func (q *webhookQueues) push(url string, ev event.Event, worker func(ctx context.Context, url string, events <-chan event.Event)) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return false
+	}
+	events, ok := q.queues[url]
+	if !ok {
+		events = make(chan event.Event, webhookQueueSize)
+		q.queues[url] = events
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			worker(q.ctx, url, events)
+		}()
+	}
+	select {
+	case events <- ev:
+		return true
+	default:
+		return false
+	}
+}
+
+// remove 地址已从配置中移除, worker 退出, 之后的事件重新创建队列
+func (q *webhookQueues) remove(url string, events <-chan event.Event) {
+	q.lock.Lock()
+	if q.queues[url] == events {
+		delete(q.queues, url)
+	}
+	q.lock.Unlock()
+}
+
+// close 停止接受事件, 取消正在进行的投递并等待 worker 退出
+func (q *webhookQueues) close() {
+	q.lock.Lock()
+	q.closed = true
+	q.lock.Unlock()
+	q.cancel()
+	q.wg.Wait()
+}
+
+// enqueueWebhook 放入订阅了该事件的地址的队列, 不阻塞发布者, 队列满时丢弃
+func (p *StorageProxy) enqueueWebhook(ev event.Event) {
+	for _, hook := range p.snapshot().Webhooks {
+		if !event.Match(hook.Events, ev.Type) {
+			continue
+		}
+		if !p.webhooks.push(hook.URL, ev, p.webhookWorker) {
+			log.Errorf(log.Fields{}, "webhook queue of %v full, drop event %v %v", hook.URL, ev.Type, ev.ID)
+			webhookDeliveries.Inc("dropped")
+		}
+	}
+}
+
+// webhookLoop 服务停止时取消正在进行的投递
+func (p *StorageProxy) webhookLoop() {
+	<-p.done
+	p.webhooks.close()
+}
+
+// webhookWorker 按顺序投递 url 的事件, 使用当前的配置
+func (p *StorageProxy) webhookWorker(ctx context.Context, url string, events <-chan event.Event) {
+	for {
+		select {
+		case ev := <-events:
+			hook, ok := p.webhook(url)
+			if !ok {
+				p.webhooks.remove(url, events)
+				return
+			}
+			p.deliverEvent(ctx, hook, ev)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// webhook 返回 url 的配置, 配置校验保证地址不重复
+func (p *StorageProxy) webhook(url string) (WebhookConfig, bool) {
+	for _, hook := range p.snapshot().Webhooks {
+		if hook.URL == url {
+			return hook, true
+		}
+	}
+	return WebhookConfig{}, false
+}
+
+func (p *StorageProxy) deliverEvent(ctx context.Context, hook WebhookConfig, ev event.Event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Errorf(log.Fields{}, "fail to marshal event %v: %v", ev.ID, err)
+		return
+	}
+	if err := deliverWebhook(ctx, hook, ev, body); err != nil {
+		log.Errorf(log.Fields{}, "fail to deliver event %v %v -> %v: %v", ev.Type, ev.ID, hook.URL, err)
+		webhookDeliveries.Inc("failed")
+		return
+	}
+	webhookDeliveries.Inc("ok")
+}
+
+// signWebhook 签名为 sha256=hex(HMAC-SHA256(secret, body))
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func deliverWebhook(ctx context.Context, hook WebhookConfig, ev event.Event, body []byte) error {
+	retries := DefaultWebhookRetries
+	if hook.Retries != nil {
+		retries = *hook.Retries
+	}
+
+	var err error
+	backoff := webhookBackoffBase
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+		if err = postWebhook(ctx, hook, ev, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func postWebhook(ctx context.Context, hook WebhookConfig, ev event.Event, body []byte) error {
+	ctx, cancel := task.RequestContext(ctx)
+	defer cancel()
+
+	req := httpdaemon.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("X-Spacemesh-Event", ev.Type).
+		SetHeader("X-Spacemesh-Delivery", ev.ID).
+		SetBody(body)
+	if hook.Secret != "" {
+		req.SetHeader(webhookSignatureKey, signWebhook(hook.Secret, body))
+	}
+	resp, err := req.Post(hook.URL)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return fmt.Errorf("status %v", resp.StatusCode())
+	}
+	return nil
+}